@@ -2,13 +2,20 @@ package api
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -27,23 +34,192 @@ import (
 
 var openapi string
 
-const sanitizeRegex = "[A-Za-z][A-Za-z0-9_]*"
+const sanitizeRegex = "^[A-Za-z][A-Za-z0-9_]*$"
 
 var sqlSanitize = regexp.MustCompile(sanitizeRegex)
 
+// batchParams caps the named params of a batch below the limits of 65535
+// on Postgres and 999 on SQLite, leaving room for the other params
+var batchParams = map[string]int{"postgres": 65000, "sqlite3": 900}
+
+// supportedTypes - column types allowed unless x-grest-column-types is set
 func supportedTypes() []string {
 	return []string{
-		"real", "text", "boolean",
+		"real", "text", "boolean", "integer", "timestamp",
 	}
 }
 
+// grestExtension - x-grest extension on an operation
+type grestExtension struct {
+	Queries []grestQuery `json:"queries"`
+	// OnConflict lists the conflict columns that turn inserts into upserts
+	OnConflict []string `json:"onConflict"`
+	// CopyFrom loads a text/csv body into a table before the queries run
+	CopyFrom *grestCopyFrom `json:"copyFrom"`
+	// CopyTo exports the final query with COPY TO STDOUT
+	CopyTo *grestCopyTo `json:"copyTo"`
+	// Upload limits multipart/form-data and application/octet-stream bodies
+	Upload *grestUpload `json:"upload"`
+	// Raw serves a column of the final query as the response body
+	Raw *grestRaw `json:"raw"`
+	// Select binds the ?select= columns and embedded relations as ._select
+	Select *grestSelect `json:"select"`
+	// Filter binds the conditions of ?column=operator.value params as ._where
+	Filter *grestFilter `json:"filter"`
+}
+
+// grestQuery - single entry of x-grest queries
+type grestQuery struct {
+	// Ref splices in a query list from components x-grest-templates
+	Ref string `json:"$ref"`
+	SQL string `json:"sql"`
+	// As binds the rows returned by the query under a name for later queries
+	As string `json:"as"`
+	// When is a template pipeline, the query is skipped unless it is true
+	When string `json:"when"`
+	// ForEach is a path like .body.lines, the query runs once per element
+	ForEach string `json:"forEach"`
+	// Item names the current ForEach element, defaults to item
+	Item string `json:"item"`
+	// Batch runs the query once per batch of .rows, rows of a batch share
+	// the same keys and their named params stay under the database limit
+	Batch bool `json:"batch"`
+}
+
+// operation - compiled x-grest extension
+type operation struct {
+	queries  []query
+	copyFrom *copyFrom
+	// copyTo is the COPY TO format of the final query, if exporting
+	copyTo string
+	// formats declared by the 200 response, any format if empty
+	formats []string
+	// strict templates quote everything with the helpers, so template
+	// params don't need to be sanitized
+	strict bool
+	// identifiers are params checked against the catalog
+	identifiers []identifier
+	// modifies is set for methods that may change the catalog
+	modifies bool
+	upload   grestUpload
+	raw      *grestRaw
+	// onConflict are the conflict columns of upserts, if fixed by the spec
+	onConflict []string
+	// rpc calls a stored function instead of running queries
+	rpc *grestRPC
+	// selection builds ._select from ?select=
+	selection *selection
+	filter    *grestFilter
+	// settings are those of the spec the operation was loaded from
+	settings *serverSettings
+}
+
+// serverSettings - settings of a loaded spec, captured by the handlers and
+// middleware of its server, so that requests still running on the routes
+// of a reloaded spec keep using them
+type serverSettings struct {
+	// securityQueries are the x-grest-password-query of the spec
+	securityQueries map[string]string
+	// catalogTTL is how long catalog names are cached, x-grest-catalog-ttl
+	catalogTTL time.Duration
+}
+
+// query - compiled x-grest query
+type query struct {
+	template *template.Template
+	as       string
+	when     *template.Template
+	forEach  []string
+	item     string
+	batch    bool
+}
+
+// enabled - evaluates the when condition of the query
+func (q query) enabled(scope map[string]interface{}) (bool, error) {
+	if q.when == nil {
+		return true, nil
+	}
+	var buffer bytes.Buffer
+	if err := q.when.Execute(&buffer, scope); err != nil {
+		return false, echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	return buffer.String() == "true", nil
+}
+
+// items - finds the elements the query loops over
+func (q query) items(scope map[string]interface{}) ([]interface{}, error) {
+	var value interface{} = scope
+	for _, key := range q.forEach {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("forEach .%s must be an object path", strings.Join(q.forEach, ".")),
+			)
+		}
+		value = obj[key]
+	}
+	switch value.(type) {
+	case nil:
+		return []interface{}{}, nil
+	case []interface{}:
+		return value.([]interface{}), nil
+	}
+	return nil, echo.NewHTTPError(
+		http.StatusBadRequest,
+		fmt.Sprintf("forEach .%s must be an array", strings.Join(q.forEach, ".")),
+	)
+}
+
+// batches - splits the rows into runs of rows with the same keys, leaving
+// out the keys a row defaults, capped so the params fit the database limit
+func batches(rows []interface{}, dialect string) []interface{} {
+	batches := []interface{}{}
+	var batch []interface{}
+	var keys string
+	for _, element := range rows {
+		row := map[string]interface{}{}
+		for col, val := range element.(map[string]interface{}) {
+			if _, ok := val.(defaultValue); !ok {
+				row[col] = val
+			}
+		}
+		names := make([]string, 0, len(row))
+		for col := range row {
+			names = append(names, col)
+		}
+		sort.Strings(names)
+		size := batchParams[dialect]
+		if len(names) > 0 {
+			size /= len(names)
+		}
+		if batch == nil || strings.Join(names, ",") != keys || len(batch) >= size {
+			if batch != nil {
+				batches = append(batches, batch)
+			}
+			batch = []interface{}{}
+			keys = strings.Join(names, ",")
+		}
+		batch = append(batch, row)
+	}
+	if batch != nil {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
 // API - API object
 type API struct {
-	sql             databaseInterface
-	securityQueries map[string]string
+	sql databaseInterface
+	// mutex guards creating the catalog
+	mutex sync.Mutex
+	// catalog caches the names the roles see, shared by the loaded servers
+	catalog *catalog
 }
 
-// NewAPI - Create new Postgres API
+// NewAPI - Create new Postgres API. SQLite URLs name a database in memory
+// (jdbc:sqlite3://name) or, containing a /, a file like
+// jdbc:sqlite3:///var/lib/grest.db or jdbc:sqlite3://./grest.db
 func NewApi(jdbc string) *API {
 	match := regexp.MustCompile(
 		"jdbc:(?P<dbtype>.+)://(?P<host>[^:]+):?(?P<port>[0-9]*)/?(?P<database>.*)",
@@ -75,6 +251,10 @@ func NewApi(jdbc string) *API {
 			log.Println("Failed to create anon role:", err)
 		}
 	case "sqlite3":
+		if location := strings.TrimPrefix(jdbc, "jdbc:sqlite3://"); strings.Contains(location, "/") {
+			return &API{sql: openSqliteFile(location)}
+		}
+		// A bare name is a database in memory, shared by the connections
 		var err error
 		db, err = sqlx.Open("sqlite3", "file:"+match[2]+"?mode=memory&cache=shared")
 		if err != nil {
@@ -88,42 +268,195 @@ func NewApi(jdbc string) *API {
 }
 
 func convertPath(path string) string {
-	return regexp.MustCompile(`\{([a-z]+)\}`).ReplaceAllString(path, ":$1")
+	return regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`).ReplaceAllString(path, ":$1")
 }
 
-// GetServer - Returns LabStack Echo Server
-func (api *API) GetServer(swaggerpath string) *echo.Echo {
+// GetServer - Returns LabStack Echo Server, exiting when the spec is invalid.
+// Several spec files, or directories of them, are merged like LoadSpec.
+func (api *API) GetServer(swaggerpaths ...string) *echo.Echo {
+	e, err := api.LoadServer(swaggerpaths...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return e
+}
+
+// LoadServer - Returns LabStack Echo Server, or why the spec is invalid. The
+// API keeps its previous settings unless the spec loads.
+func (api *API) LoadServer(swaggerpaths ...string) (*echo.Echo, error) {
 	e := echo.New()
 
-	swagger, err := openapi3.NewSwaggerLoader().LoadSwaggerFromFile(swaggerpath)
+	swagger, err := LoadSpec(swaggerpaths...)
+	if err != nil {
+		return nil, err
+	}
+	strict := false
+	if value, ok := swagger.Extensions["x-grest-strict-templates"]; ok {
+		if err := json.Unmarshal(value.(json.RawMessage), &strict); err != nil {
+			return nil, fmt.Errorf("Extension x-grest-strict-templates must be boolean : %s", err)
+		}
+	}
+	quoting := dialectOf(api.sql.DriverName())
+	if value, ok := swagger.Extensions["x-grest-column-types"]; ok {
+		whitelist := []string{}
+		if err := json.Unmarshal(value.(json.RawMessage), &whitelist); err != nil {
+			return nil, fmt.Errorf("Extension x-grest-column-types must be a list of types : %s", err)
+		}
+		if quoting.types, err = allowedTypes(api.sql.DriverName(), whitelist); err != nil {
+			return nil, fmt.Errorf("Extension x-grest-column-types : %s", err)
+		}
+	}
+	funcs := quoting.funcs()
+	partials, refs, err := parseTemplates(
+		rawExtension(swagger.Components.Extensions["x-grest-templates"]), funcs,
+	)
 	if err != nil {
-		log.Fatal("Failed to load swagger", err)
+		return nil, fmt.Errorf("Failed to parse components x-grest-templates : %s", err)
+	}
+	ttl := defaultCatalogTTL
+	if value, ok := swagger.Extensions["x-grest-catalog-ttl"]; ok {
+		var duration string
+		if err := json.Unmarshal(value.(json.RawMessage), &duration); err != nil {
+			return nil, fmt.Errorf("Extension x-grest-catalog-ttl must be a duration : %s", err)
+		}
+		if ttl, err = time.ParseDuration(duration); err != nil {
+			return nil, fmt.Errorf("Extension x-grest-catalog-ttl must be a duration : %s", err)
+		}
 	}
+	// Filled in below, and only shared with the routes of this server
+	loaded := &serverSettings{securityQueries: map[string]string{}, catalogTTL: ttl}
+	// The connecting address is the remote IP, forwarding headers are only
+	// believed from the trusted proxies
+	e.IPExtractor = echo.ExtractIPDirect()
+	if value, ok := swagger.Extensions["x-grest-trusted-proxies"]; ok {
+		ranges := []string{}
+		if err := json.Unmarshal(value.(json.RawMessage), &ranges); err != nil {
+			return nil, fmt.Errorf("Extension x-grest-trusted-proxies must be a list of CIDRs : %s", err)
+		}
+		options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+		for _, cidr := range ranges {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("Extension x-grest-trusted-proxies : %s", err)
+			}
+			options = append(options, echo.TrustIPRange(network))
+		}
+		e.IPExtractor = echo.ExtractIPFromXFFHeader(options...)
+	}
+	if value, ok := swagger.Extensions["x-grest-auto"]; ok {
+		if err := api.addAuto(swagger, value.(json.RawMessage)); err != nil {
+			return nil, fmt.Errorf("Failed to add x-grest-auto tables : %s", err)
+		}
+	}
+	dialect := catalogDialect(api.sql.DriverName())
+	queries := catalogQueries[dialect]
 	for path, item := range swagger.Paths {
-		for method, op := range item.Operations() {
-			if grest, ok := op.Extensions["x-grest"]; ok {
-				queries := map[string][]map[string]interface{}{} // Fun type
-				if err := json.Unmarshal(grest.(json.RawMessage), &queries); err != nil {
-					log.Fatal(
-						"Failed to parse x-grest at",
-						path, " ", method, " : ", err,
-						"  ", string(grest.(json.RawMessage)),
+		for method, spec := range item.Operations() {
+			grest, ok := spec.Extensions["x-grest"]
+			rpc, isRPC := spec.Extensions["x-grest-rpc"]
+			if isRPC && !ok {
+				// Function calls need no queries
+				grest, ok = json.RawMessage(`{}`), true
+			}
+			if ok {
+				at := path + " " + method
+				ext, err := resolveExtension(grest.(json.RawMessage), refs)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"Failed to parse x-grest at %s : %s  %s", at, err, string(grest.(json.RawMessage)),
 					)
 				}
-				templates := []*template.Template{}
-				for i, query := range queries["queries"] {
-					sql, ok := query["sql"]
-					if !ok {
-						log.Fatal("Failed to get 'sql' from GREST Swagger extension at", path, method)
+				op := operation{
+					formats:    responseFormats(spec.Responses),
+					strict:     strict,
+					modifies:   method != http.MethodGet && method != http.MethodHead,
+					onConflict: ext.OnConflict,
+					settings:   loaded,
+				}
+				if value, ok := spec.Extensions["x-grest-strict-templates"]; ok {
+					// Operations may opt in or out, like generated ones
+					if err := json.Unmarshal(value.(json.RawMessage), &op.strict); err != nil {
+						return nil, fmt.Errorf("Extension x-grest-strict-templates must be boolean at %s : %s", at, err)
+					}
+				}
+				for i, q := range ext.Queries {
+					if q.SQL == "" {
+						return nil, fmt.Errorf("Failed to get 'sql' from GREST Swagger extension at %s", at)
+					}
+					compiled := query{as: q.As, item: q.Item}
+					if compiled.template, err = parsePartial(partials, fmt.Sprintf("%s %d", at, i), q.SQL); err != nil {
+						return nil, err
+					}
+					if err := checkPartials(compiled.template); err != nil {
+						return nil, err
+					}
+					if op.strict {
+						if err := checkStrict(compiled.template); err != nil {
+							return nil, fmt.Errorf("Strict templates : %s", err)
+						}
+					} else if err := checkBuiltins(compiled.template); err != nil {
+						return nil, err
+					}
+					if q.When != "" {
+						compiled.when, err = template.New(
+							fmt.Sprintf("%s %d when", at, i),
+						).Funcs(funcs).Parse("{{if " + q.When + "}}true{{end}}")
+						if err != nil {
+							return nil, err
+						}
+					}
+					if q.Batch && q.ForEach != "" {
+						return nil, fmt.Errorf("%s %d : batch and forEach can't be combined", at, i)
+					}
+					compiled.batch = q.Batch
+					if q.ForEach != "" {
+						compiled.forEach = strings.Split(strings.TrimPrefix(q.ForEach, "."), ".")
+						if compiled.item == "" {
+							compiled.item = "item"
+						}
+					}
+					op.queries = append(op.queries, compiled)
+				}
+				if ext.CopyFrom != nil {
+					if op.copyFrom, err = ext.CopyFrom.compile(at+" copyFrom", partials); err != nil {
+						return nil, err
+					}
+				}
+				if op.upload, err = ext.Upload.compile(at + " upload"); err != nil {
+					return nil, err
+				}
+				op.filter = ext.Filter
+				if ext.Select != nil {
+					if op.selection, err = ext.Select.compile(at + " select"); err != nil {
+						return nil, err
+					}
+				}
+				if ext.Raw != nil {
+					if op.raw, err = ext.Raw.compile(at + " raw"); err != nil {
+						return nil, err
+					}
+				}
+				if ext.CopyTo != nil {
+					if op.copyTo, err = ext.CopyTo.compile(at + " copyTo"); err != nil {
+						return nil, err
+					}
+				}
+				if isRPC {
+					if len(op.queries) > 0 || op.copyFrom != nil || op.copyTo != "" {
+						return nil, fmt.Errorf("Extension x-grest-rpc can't be combined with queries or copy at %s", at)
+					}
+					settings := &grestRPC{}
+					if err := json.Unmarshal(rpc.(json.RawMessage), settings); err != nil {
+						return nil, fmt.Errorf("Failed to parse x-grest-rpc at %s : %s", at, err)
+					}
+					if op.rpc, err = settings.compile(at, dialect); err != nil {
+						return nil, err
 					}
-					templates = append(templates, template.Must(template.New(
-						fmt.Sprintf("%s %s %d", path, method, i),
-					).Parse(sql.(string))))
 				}
 
 				// Copy out params
 				params := []openapi3.Parameter{}
-				for i, param := range op.Parameters {
+				for i, param := range spec.Parameters {
 					params = append(params, *param.Value)
 					if template, ok := params[i].Extensions["x-grest-template-allowed"]; ok {
 						if _, ok := template.(json.RawMessage); ok {
@@ -133,28 +466,44 @@ func (api *API) GetServer(swaggerpath string) *echo.Echo {
 
 						// Final check
 						if _, ok := params[i].Extensions["x-grest-template-allowed"].(bool); !ok {
-							log.Fatal(
-								"Extension x-grest-template-allowed must be boolean on",
-								path, " ", method, " ", params[i].Name,
-								" not ", reflect.TypeOf(template),
+							return nil, fmt.Errorf(
+								"Extension x-grest-template-allowed must be boolean on %s %s not %s",
+								at, params[i].Name, reflect.TypeOf(template),
 							)
 						}
 					}
+					if value, ok := params[i].Extensions["x-grest-identifier"]; ok {
+						compiled := identifier{param: paramKey(params[i].Name)}
+						if err := json.Unmarshal(value.(json.RawMessage), &compiled.grestIdentifier); err != nil {
+							return nil, fmt.Errorf(
+								"Failed to parse x-grest-identifier on %s %s : %s", at, params[i].Name, err,
+							)
+						}
+						if _, ok := queries[compiled.Kind]; !ok {
+							return nil, fmt.Errorf(
+								"Unsupported x-grest-identifier kind %s on %s %s", compiled.Kind, at, params[i].Name,
+							)
+						}
+						op.identifiers = append(op.identifiers, compiled)
+					}
+				}
+				if err := checkScopes(at, op.identifiers, params); err != nil {
+					return nil, err
 				}
 
 				bodyAllowed := false
-				if op.RequestBody != nil {
-					if template, ok := op.RequestBody.Value.Extensions["x-grest-template-allowed"]; ok {
+				if requestBody := spec.RequestBody; requestBody != nil {
+					if template, ok := requestBody.Value.Extensions["x-grest-template-allowed"]; ok {
 						if _, ok := template.(json.RawMessage); ok {
-							op.RequestBody.Value.Extensions["x-grest-template-allowed"] = strings.ToLower(
+							requestBody.Value.Extensions["x-grest-template-allowed"] = strings.ToLower(
 								string(template.(json.RawMessage))) == "true"
 						}
 
 						// Final check
-						if allowed, ok := op.RequestBody.Value.Extensions["x-grest-template-allowed"].(bool); !ok {
-							log.Fatal(
-								"RequestBody Extension x-grest-template-allowed must be boolean on",
-								path, " ", method, " not ", reflect.TypeOf(template),
+						if allowed, ok := requestBody.Value.Extensions["x-grest-template-allowed"].(bool); !ok {
+							return nil, fmt.Errorf(
+								"RequestBody Extension x-grest-template-allowed must be boolean on %s not %s",
+								at, reflect.TypeOf(template),
 							)
 						} else {
 							bodyAllowed = allowed
@@ -162,57 +511,36 @@ func (api *API) GetServer(swaggerpath string) *echo.Echo {
 					}
 				}
 
-				e.Add(method, convertPath(path), func(c echo.Context) error {
-					templateParams, queryParams := map[string]interface{}{}, map[string]interface{}{}
-					for _, param := range params {
-						switch param.In {
-						case "path":
-							queryParams[param.Name] = c.Param(param.Name)
-							if allowed, ok := param.Extensions["x-grest-template-allowed"]; ok && allowed.(bool) {
-								templateParams[param.Name] = c.Param(param.Name)
-							}
-						case "query":
-							queryParams[param.Name] = c.QueryParam(param.Name)
-							if allowed, ok := param.Extensions["x-grest-template-allowed"]; ok && allowed.(bool) {
-								templateParams[param.Name] = c.QueryParam(param.Name)
-							}
-						}
-					}
-					body := map[string]interface{}{}
-					if err := (&echo.DefaultBinder{}).BindBody(c, &body); err != nil {
-						log.Fatal(err)
-						return err
-					}
-
-					// Can't do nested in SQL
-					for key, val := range body {
-						queryParams[key] = val
-					}
-					if bodyAllowed {
-						templateParams["body"] = body
-					}
-
-					var username string
-					switch c.Get("username").(type) {
-					case string:
-						username = c.Get("username").(string)
-					default:
-						username = "anon"
-					}
+				e.Add(method, convertPath(path), api.handler(op, params, bodyAllowed))
+			}
+		}
+	}
 
-					results, err := api.runQuery(
-						username,
-						templates, templateParams, queryParams,
-					)
+	if value, ok := swagger.Extensions["x-grest-rpc"]; ok {
+		settings := &grestRPC{param: "function"}
+		if err := json.Unmarshal(value.(json.RawMessage), settings); err != nil {
+			return nil, fmt.Errorf("Failed to parse x-grest-rpc : %s", err)
+		}
+		if settings.Function != "" {
+			return nil, fmt.Errorf("Extension x-grest-rpc on the spec takes the function from the path")
+		}
+		op := operation{strict: strict, modifies: true, settings: loaded}
+		if op.rpc, err = settings.compile(rpcPath, dialect); err != nil {
+			return nil, err
+		}
+		e.POST(rpcPath, api.handler(op, []openapi3.Parameter{{In: "path", Name: "function"}}, false))
+		addRPCPath(swagger)
+	}
 
-					if err == nil {
-						return c.JSON(http.StatusOK, results)
-					}
-					return err
-				})
-			}
+	docs := grestDocs{}
+	if value, ok := swagger.Extensions["x-grest-docs"]; ok {
+		if err := json.Unmarshal(value.(json.RawMessage), &docs); err != nil {
+			return nil, fmt.Errorf("Failed to parse x-grest-docs : %s", err)
 		}
 	}
+	if err := addDocs(e, swagger, docs); err != nil {
+		return nil, err
+	}
 
 	for _, req := range swagger.Security {
 		for provider, _ := range req {
@@ -222,58 +550,439 @@ func (api *API) GetServer(swaggerpath string) *echo.Echo {
 				switch securityScheme.Scheme {
 				case "basic":
 					if err := json.Unmarshal(
-						securityScheme.Extensions["x-grest-password-query"].(json.RawMessage), &api.securityQueries); err != nil {
-						log.Fatal(
-							"Failed to parse x-grest-password-query at",
-							provider, " : ", err,
-							"  ", string(securityScheme.Extensions["x-grest-password-query"].(json.RawMessage)),
+						securityScheme.Extensions["x-grest-password-query"].(json.RawMessage), &loaded.securityQueries); err != nil {
+						return nil, fmt.Errorf(
+							"Failed to parse x-grest-password-query at %s : %s  %s", provider, err,
+							string(securityScheme.Extensions["x-grest-password-query"].(json.RawMessage)),
 						)
 					}
-					api.addBasicAuth(e)
+					api.addBasicAuth(e, loaded)
 				default:
-					log.Fatal("Unsupported http security scheme", securityScheme.Scheme)
+					return nil, fmt.Errorf("Unsupported http security scheme %s", securityScheme.Scheme)
 				}
 			default:
-				log.Fatal("Unsupported security type", securityScheme.Type)
+				return nil, fmt.Errorf("Unsupported security type %s", securityScheme.Type)
 			}
 		}
 	}
 
-	return e
+	// Only now that the spec loaded, so a failed reload keeps the cache.
+	// A reloaded spec may be for a migrated schema, so the cache is
+	// forgotten rather than kept.
+	api.mutex.Lock()
+	if api.catalog == nil {
+		api.catalog = newCatalog()
+	} else {
+		api.catalog.refresh()
+	}
+	api.mutex.Unlock()
+
+	return e, nil
 }
 
-//// Core working code
+// handler - binds the params and body of a request and runs the operation
+func (api *API) handler(op operation, params []openapi3.Parameter, bodyAllowed bool) echo.HandlerFunc {
+	dialect := catalogDialect(api.sql.DriverName())
+	declared := map[string]bool{}
+	for _, param := range params {
+		if param.In == "query" {
+			declared[param.Name] = true
+		}
+	}
+	return func(c echo.Context) error {
+		templateParams, queryParams := map[string]interface{}{}, map[string]interface{}{}
+		requestParams := map[string]interface{}{}
+		for _, param := range params {
+			var value string
+			switch param.In {
+			case "path":
+				value = c.Param(param.Name)
+			case "query":
+				value = c.QueryParam(param.Name)
+			case "header":
+				value = c.Request().Header.Get(param.Name)
+			case "cookie":
+				if cookie, err := c.Cookie(param.Name); err == nil {
+					value = cookie.Value
+				}
+			}
+			if value == "" && param.Schema != nil && param.Schema.Value != nil && param.Schema.Value.Default != nil {
+				value = fmt.Sprint(param.Schema.Value.Default)
+			}
+			name := paramKey(param.Name)
+			requestParams[name] = value
+			queryParams[name] = value
+			if allowed, ok := param.Extensions["x-grest-template-allowed"]; ok && allowed.(bool) {
+				templateParams[name] = value
+			}
+		}
+		var body interface{} = map[string]interface{}{}
+		var csvBody io.Reader
+		var upload *uploadBody
+		if op.copyFrom != nil {
+			if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), "text/csv") {
+				return echo.NewHTTPError(http.StatusUnsupportedMediaType, "copyFrom requires text/csv")
+			}
+			csvBody = c.Request().Body
+		} else if isUpload(c) {
+			upload = &uploadBody{op.upload, c.Request()}
+		} else {
+			var err error
+			if body, err = bindBody(c); err != nil {
+				log.Println("Failed to bind body", err)
+				return err
+			}
+		}
 
-func sanitize(params map[string]interface{}) error {
-	for k, v := range params {
-		switch v.(type) {
-		case string:
-			if !sqlSanitize.Match([]byte(k)) || !sqlSanitize.Match([]byte(v.(string))) {
+		if csvBody == nil && upload == nil {
+			if err := bodyParams(body, dialect, queryParams); err != nil {
+				return err
+			}
+		}
+		rows, err := bodyRows(body)
+		if err != nil {
+			return err
+		}
+		bindRows(rows, dialect, queryParams)
+		var where []safeSQL
+		if op.filter != nil {
+			conditions, filterParams, err := parseFilters(c.QueryParams(), declared, dialect)
+			if err != nil {
+				return err
+			}
+			if len(conditions) == 0 && !op.filter.Unfiltered {
 				return echo.NewHTTPError(
-					http.StatusBadRequest,
-					fmt.Sprintf("'%s' and '%s' must match /%s/", k, v, sanitizeRegex),
+					http.StatusBadRequest, "Refusing to affect every row, filter with ?column=eq.value",
 				)
 			}
-		case map[string]interface{}:
-			if !sqlSanitize.Match([]byte(k)) {
+			for key, value := range filterParams {
+				queryParams[key] = value
+			}
+			where = conditions
+		}
+		if bodyAllowed {
+			templateParams["body"] = body
+			templateParams["rows"] = rows
+		}
+
+		if len(op.onConflict) > 0 {
+			templateParams["onConflict"] = op.onConflict
+		} else if strings.Contains(
+			c.Request().Header.Get("Prefer"), "resolution=merge-duplicates",
+		) {
+			if c.QueryParam("on_conflict") == "" {
 				return echo.NewHTTPError(
 					http.StatusBadRequest,
-					fmt.Sprintf("'%s' and '%s' must match /%s/", k, v, sanitizeRegex),
+					"resolution=merge-duplicates requires on_conflict columns",
 				)
 			}
-			return sanitize(v.(map[string]interface{}))
+			templateParams["onConflict"] = strings.Split(c.QueryParam("on_conflict"), ",")
+		}
+
+		var username string
+		switch c.Get("username").(type) {
+		case string:
+			username = c.Get("username").(string)
+		default:
+			username = "anon"
+		}
+
+		var output encoder
+		var export io.WriteCloser
+		if op.raw != nil {
+			output = newRawResponse(c, op.raw)
+		} else if op.copyTo != "" {
+			export = newExportWriter(c, op.copyTo)
+		} else if output, err = negotiate(c, op.formats); err != nil {
+			return err
+		}
+
+		builtins, err := builtinParams(c)
+		if err != nil {
+			return err
+		}
+
+		run := request{
+			username:       username,
+			templateParams: templateParams,
+			queryParams:    queryParams,
+			scope:          map[string]interface{}{"params": requestParams, "body": body},
+			builtins:       builtins,
+			where:          where,
+			upload:         upload,
+			csvBody:        csvBody,
+			output:         output,
+			export:         export,
+		}
+		if op.modifies {
+			return bufferResponse(c.Response()).finish(api.runQuery(op, run))
+		}
+		return api.runQuery(op, run)
+	}
+}
+
+// bindBody - decodes JSON bodies of any shape, other content types are
+// bound into a map
+func bindBody(c echo.Context) (interface{}, error) {
+	req := c.Request()
+	if req.ContentLength != 0 && strings.HasPrefix(
+		req.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON,
+	) {
+		var body interface{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err == io.EOF {
+			return map[string]interface{}{}, nil
+		} else if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return body, nil
+	}
+
+	body := map[string]interface{}{}
+	if err := (&echo.DefaultBinder{}).BindBody(c, &body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// defaultValue - fills the columns a row of an array body leaves out, the
+// placeholders and assign helpers print DEFAULT for it
+type defaultValue struct{}
+
+// bodyRows - returns the body as rows sharing the same columns, missing
+// columns are defaultValue and an object body is a single row
+func bodyRows(body interface{}) ([]interface{}, error) {
+	switch body.(type) {
+	case map[string]interface{}:
+		if len(body.(map[string]interface{})) == 0 {
+			return []interface{}{}, nil
+		}
+		return []interface{}{body}, nil
+	case []interface{}:
+		elements := body.([]interface{})
+		if len(elements) == 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Array body must not be empty")
+		}
+		columns := map[string]bool{}
+		for _, element := range elements {
+			row, ok := element.(map[string]interface{})
+			if !ok {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, "Array body must only contain objects")
+			}
+			for col := range row {
+				columns[col] = true
+			}
+		}
+		rows := make([]interface{}, len(elements))
+		for i, element := range elements {
+			row := map[string]interface{}{}
+			for col := range columns {
+				if val, ok := element.(map[string]interface{})[col]; ok {
+					row[col] = val
+				} else {
+					row[col] = defaultValue{}
+				}
+			}
+			rows[i] = row
 		}
+		return rows, nil
+	}
+	return []interface{}{}, nil
+}
 
+// bindRows - binds the rows as :rows.N.column, defaulted columns are null
+func bindRows(rows []interface{}, dialect string, queryParams map[string]interface{}) {
+	for i, row := range rows {
+		for col, val := range row.(map[string]interface{}) {
+			if _, ok := val.(defaultValue); ok {
+				val = nil
+			}
+			queryParams[fmt.Sprintf("rows.%d.%s", i, col)] = paramValue(val, dialect)
+		}
+	}
+}
+
+// bindBatch - copies the params without rows, binding a batch of rows
+func bindBatch(
+	batch []interface{}, dialect string, withoutRows map[string]interface{},
+	templateParams map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+
+	params := make(map[string]interface{}, len(withoutRows))
+	for key, val := range withoutRows {
+		params[key] = val
+	}
+	bindRows(batch, dialect, params)
+	batchTemplateParams := make(map[string]interface{}, len(templateParams))
+	for key, val := range templateParams {
+		batchTemplateParams[key] = val
+	}
+	batchTemplateParams["rows"] = batch
+	return params, batchTemplateParams
+}
+
+// paramKey - the named parameter of a spec parameter, as names like
+// X-Tenant-Id aren't valid named parameters they become X_Tenant_Id
+func paramKey(name string) string {
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// Built-in params, bound as :_user and so on. Templates only see them
+// when strict, as their values don't pass sanitize.
+var builtinNames = map[string]bool{"_user": true, "_request_id": true, "_remote_ip": true, "_now": true}
+
+// builtinParams - the request built-ins available as :_request_id,
+// :_remote_ip and :_now. The remote IP comes from the IPExtractor, which
+// only believes forwarding headers from x-grest-trusted-proxies.
+func builtinParams(c echo.Context) (map[string]interface{}, error) {
+	id, err := requestID(c)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"_request_id": id,
+		"_remote_ip":  c.RealIP(),
+		"_now":        time.Now().UTC(),
+	}, nil
+}
+
+var requestIDRegex = regexp.MustCompile("^[A-Za-z0-9_.-]{1,128}$")
+
+// requestID - the id from the RequestID middleware or the client, otherwise
+// a new one, echoed in the response
+func requestID(c echo.Context) (string, error) {
+	id := c.Response().Header().Get(echo.HeaderXRequestID)
+	if id == "" {
+		id = c.Request().Header.Get(echo.HeaderXRequestID)
+	}
+	if !requestIDRegex.MatchString(id) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Println("Failed to generate request id", err)
+			return "", echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+		id = hex.EncodeToString(b)
+	}
+	c.Response().Header().Set(echo.HeaderXRequestID, id)
+	return id, nil
+}
+
+// bodyParams - binds the body as :_body, its keys as :key and nested values
+// as :key.nested or :key.0 for array elements
+func bodyParams(body interface{}, dialect string, params map[string]interface{}) error {
+	if obj, ok := body.(map[string]interface{}); ok {
+		for key, val := range obj {
+			flattenParam(key, val, dialect, params)
+		}
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	params["_body"] = string(raw)
+	return nil
+}
+
+func flattenParam(name string, value interface{}, dialect string, params map[string]interface{}) {
+	params[name] = paramValue(value, dialect)
+	switch value.(type) {
+	case map[string]interface{}:
+		for key, val := range value.(map[string]interface{}) {
+			flattenParam(name+"."+key, val, dialect, params)
+		}
+	case []interface{}:
+		for i, val := range value.([]interface{}) {
+			flattenParam(fmt.Sprintf("%s.%d", name, i), val, dialect, params)
+		}
+	}
+}
+
+// paramValue - objects are bound as JSON text, so they can be cast to
+// jsonb, and arrays of scalars as Postgres arrays (JSON text on SQLite)
+func paramValue(value interface{}, dialect string) interface{} {
+	switch value.(type) {
+	case map[string]interface{}:
+		raw, _ := json.Marshal(value)
+		return string(raw)
+	case []interface{}:
+		if dialect == "postgres" {
+			scalars := true
+			for _, element := range value.([]interface{}) {
+				switch element.(type) {
+				case map[string]interface{}, []interface{}:
+					scalars = false
+				}
+			}
+			if scalars {
+				return pq.Array(value)
+			}
+		}
+		raw, _ := json.Marshal(value)
+		return string(raw)
+	}
+	return value
+}
+
+//// Core working code
+
+func sanitize(params map[string]interface{}) error {
+	for k, v := range params {
+		if !sqlSanitize.Match([]byte(k)) {
+			return echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("'%s' must match /%s/", k, sanitizeRegex),
+			)
+		}
+		if err := sanitizeValue(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sanitizeValue(k string, v interface{}) error {
+	switch v.(type) {
+	case string:
+		if !sqlSanitize.Match([]byte(v.(string))) {
+			return echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("'%s' and '%s' must match /%s/", k, v, sanitizeRegex),
+			)
+		}
+	case []string:
+		for _, element := range v.([]string) {
+			if err := sanitizeValue(k, element); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, element := range v.([]interface{}) {
+			if err := sanitizeValue(k, element); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		return sanitize(v.(map[string]interface{}))
 	}
 	return nil
 }
 
 func errorMapping(err error) error {
-	if pgerr, ok := err.(pgx.PgError); ok {
+	if copyerr, ok := err.(copyError); ok {
+		code := http.StatusBadRequest
+		if _, ok := copyerr.err.(*csv.ParseError); !ok {
+			code = errorMapping(copyerr.err).(*echo.HTTPError).Code
+		}
+		return echo.NewHTTPError(code, map[string]interface{}{
+			"error": copyerr.err.Error(),
+			"line":  copyerr.line,
+		})
+	} else if pgerr, ok := err.(pgx.PgError); ok {
 		code, ok := map[string]int{
-			pgerrcode.UndefinedTable:        http.StatusNotFound,
-			pgerrcode.InsufficientPrivilege: http.StatusForbidden,
-			pgerrcode.UndefinedObject:       http.StatusNotFound,
+			pgerrcode.UndefinedTable:            http.StatusNotFound,
+			pgerrcode.InsufficientPrivilege:     http.StatusForbidden,
+			pgerrcode.UndefinedObject:           http.StatusNotFound,
+			pgerrcode.UniqueViolation:           http.StatusConflict,
+			pgerrcode.BadCopyFileFormat:         http.StatusBadRequest,
+			pgerrcode.InvalidTextRepresentation: http.StatusBadRequest,
 		}[pgerr.Code]
 		if !ok {
 			log.Println("Couldn't find error code", pgerr.Code)
@@ -282,9 +991,12 @@ func errorMapping(err error) error {
 		return echo.NewHTTPError(code, err)
 	} else if pgerr, ok := err.(*pq.Error); ok {
 		code, ok := map[pq.ErrorCode]int{
-			pgerrcode.UndefinedTable:        http.StatusNotFound,
-			pgerrcode.InsufficientPrivilege: http.StatusForbidden,
-			pgerrcode.UndefinedObject:       http.StatusNotFound,
+			pgerrcode.UndefinedTable:            http.StatusNotFound,
+			pgerrcode.InsufficientPrivilege:     http.StatusForbidden,
+			pgerrcode.UndefinedObject:           http.StatusNotFound,
+			pgerrcode.UniqueViolation:           http.StatusConflict,
+			pgerrcode.BadCopyFileFormat:         http.StatusBadRequest,
+			pgerrcode.InvalidTextRepresentation: http.StatusBadRequest,
 		}[pgerr.Code]
 		if !ok {
 			log.Println("Couldn't find error code", pgerr.Code)
@@ -293,23 +1005,166 @@ func errorMapping(err error) error {
 		return echo.NewHTTPError(code, err)
 	} else if sqlite3err, ok := err.(sqlite3.Error); ok {
 		code, ok := map[sqlite3.ErrNo]int{
-			sqlite3.ErrError: http.StatusNotFound,
+			sqlite3.ErrConstraint: http.StatusConflict,
 		}[sqlite3err.Code]
+		// SQLite has no code of its own for missing tables
+		if sqlite3err.Code == sqlite3.ErrError && strings.HasPrefix(err.Error(), "no such table") {
+			code, ok = http.StatusNotFound, true
+		}
 		if !ok {
 			log.Println("Couldn't find error code", sqlite3err.Code)
 			code = http.StatusInternalServerError
 		}
-		return echo.NewHTTPError(code, err)
+		// The fields of sqlite3.Error leave out the message
+		return echo.NewHTTPError(code, err.Error())
 	}
 
 	log.Println("Error type not handled", reflect.TypeOf(err))
 	return echo.NewHTTPError(http.StatusInternalServerError, err)
 }
 
-func (api *API) runQuery(
-	username string, queryTemplates []*template.Template, templateParams map[string]interface{},
-	queryParams map[string]interface{}) ([]map[string]interface{}, error) {
+// writeRows - streams and closes all rows
+func writeRows(rows rowsInterface, output encoder) error {
+	fail := func(err error) error {
+		if err := rows.Close(); err != nil {
+			log.Fatal(err)
+		}
+		return err
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		log.Println("Failed to get columns", err)
+		return fail(errorMapping(err))
+	}
+	if err := output.Begin(columns); err != nil {
+		log.Println("Failed to write rows", err)
+		return fail(err)
+	}
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			log.Println("Failed to scan row", err)
+			return fail(echo.NewHTTPError(http.StatusInternalServerError, err))
+		}
+		if err := output.Encode(row); err != nil {
+			log.Println("Failed to write row", err)
+			return fail(err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Failed to fetch rows", err)
+		return fail(errorMapping(err))
+	}
+	if err := rows.Close(); err != nil {
+		log.Fatal(err)
+	}
+	return nil
+}
+
+// collector - keeps rows in memory so they can be bound for later queries
+type collector struct {
+	rows []map[string]interface{}
+}
+
+func (c *collector) Begin(columns []string) error {
+	return nil
+}
+
+func (c *collector) Encode(row map[string]interface{}) error {
+	c.rows = append(c.rows, row)
+	return nil
+}
+
+func (c *collector) End() error {
+	return nil
+}
+
+// bindResult - exposes the first row of a query result as :name.column
+// to later queries and as {{.name.column}} to their templates
+func bindResult(
+	name string, results []map[string]interface{},
+	templateParams map[string]interface{}, queryParams map[string]interface{}) {
+
+	row := map[string]interface{}{}
+	if len(results) > 0 {
+		for col, val := range results[0] {
+			queryParams[name+"."+col] = val
+			if b, ok := val.([]byte); ok {
+				val = string(b)
+			}
+			row[col] = val
+		}
+	}
+	templateParams[name] = row
+}
+
+// bindItem - copies the params adding a forEach element as :name, with
+// :name.key for nested values
+func bindItem(
+	name string, item interface{}, dialect string, queryParams map[string]interface{}) map[string]interface{} {
+
+	params := make(map[string]interface{}, len(queryParams))
+	for key, val := range queryParams {
+		params[key] = val
+	}
+	flattenParam(name, item, dialect, params)
+	return params
+}
+
+// execQuery - renders and runs a single query, writing rows to output
+// unless it is nil
+func (api *API) execQuery(
+	txn txInterface, query query, templateParams map[string]interface{},
+	queryParams map[string]interface{}, output encoder) error {
+
+	var queryBuffer bytes.Buffer
+	if err := query.template.Execute(&queryBuffer, templateParams); err != nil {
+		log.Println("Template failed", err)
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 
+	log.Println(string(queryBuffer.Bytes()))
+	if output == nil {
+		if _, err := txn.NamedExec(string(queryBuffer.Bytes()), queryParams); err != nil {
+			log.Println("Failed to run query", err)
+			return errorMapping(err)
+		}
+		return nil
+	}
+
+	rows, err := txn.NamedQuery(string(queryBuffer.Bytes()), queryParams)
+	if err != nil {
+		log.Println("Failed to run query", err)
+		return errorMapping(err)
+	}
+	return writeRows(rows, output)
+}
+
+// request - values of a single request needed by runQuery
+type request struct {
+	username       string
+	templateParams map[string]interface{}
+	queryParams    map[string]interface{}
+	// scope holds the raw params, body and results for when and forEach
+	scope   map[string]interface{}
+	csvBody io.Reader
+	// output receives the rows of the final query
+	output encoder
+	// export receives the COPY TO output of the final query instead
+	export io.WriteCloser
+	// builtins are the _ prefixed params, _user is added by runQuery
+	builtins map[string]interface{}
+	// upload is read once the transaction started
+	upload *uploadBody
+	// where are the filter conditions, if the operation filters
+	where []safeSQL
+}
+
+func (api *API) runQuery(op operation, req request) error {
+	username := req.username
+	templateParams, queryParams, scope := req.templateParams, req.queryParams, req.scope
+	dialect := catalogDialect(api.sql.DriverName())
 	if !sqlSanitize.Match([]byte(username)) {
 		log.Println("Using anon Role")
 		username = "anon"
@@ -318,89 +1173,204 @@ func (api *API) runQuery(
 	var txn txInterface
 	{
 		var err error
-		txn, err = api.sql.Beginx()
+		if op.modifies {
+			txn, err = api.sql.BeginWrite()
+		} else {
+			txn, err = api.sql.Beginx()
+		}
 		if err != nil {
 			log.Println("Failed to open transaction", err)
-			return nil, echo.NewHTTPError(http.StatusInternalServerError, err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
 		}
 	}
-
-	if err := api.setUser(txn, username); err != nil {
-		log.Println("Failed to set role", err)
+	rollback := func(err error) error {
 		if err := txn.Rollback(); err != nil {
 			log.Fatal(err)
 		}
-		return nil, echo.NewHTTPError(http.StatusUnauthorized, err)
+		return err
+	}
+
+	if err := op.settings.setUser(txn, username); err != nil {
+		log.Println("Failed to set role", err)
+		return rollback(echo.NewHTTPError(http.StatusUnauthorized, err))
+	}
+
+	// Before rendering anything, as the role sees the catalog
+	if err := api.checkIdentifiers(
+		txn, op.settings.catalogTTL, username, op.identifiers, scope["params"].(map[string]interface{}),
+	); err != nil {
+		return rollback(err)
+	}
+
+	if req.upload != nil {
+		if err := req.upload.bind(txn, queryParams); err != nil {
+			log.Println("Failed to read upload", err)
+			return rollback(err)
+		}
+	}
+
+	// Added last, so neither params nor the body can override them
+	builtins := map[string]interface{}{"_user": username}
+	for key, value := range req.builtins {
+		builtins[key] = value
+	}
+	for key, value := range builtins {
+		queryParams[key] = value
+		scope[key] = value
+		if op.strict {
+			// Only strict templates, as the values don't pass sanitize
+			templateParams[key] = value
+		}
 	}
 
 	// Sanitize
-	if err := sanitize(templateParams); err != nil {
-		log.Println("Failed to sanitize params", err)
-		return nil, err
+	if !op.strict {
+		if err := sanitize(templateParams); err != nil {
+			log.Println("Failed to sanitize params", err)
+			return rollback(err)
+		}
 	}
 
-	var rows rowsInterface
-	for i, queryTemplate := range queryTemplates {
-		var queryBuffer bytes.Buffer
-		if err := queryTemplate.Execute(&queryBuffer, templateParams); err != nil {
-			log.Println("Template failed", err)
-			return nil, err
+	if op.filter != nil {
+		templateParams["_where"] = req.where
+		if len(req.where) == 0 {
+			templateParams["_where"] = []safeSQL{"1 = 1"}
 		}
+	}
+	if op.selection != nil {
+		list, embedded, err := api.selectColumns(
+			txn, op.selection, templateParams, scope["params"].(map[string]interface{}),
+		)
+		if err != nil {
+			log.Println("Failed to build select", err)
+			return rollback(err)
+		}
+		templateParams["_select"] = list
+		if len(embedded) > 0 && req.output != nil {
+			req.output = &embedEncoder{req.output, embedded}
+		}
+	}
 
-		log.Println(string(queryBuffer.Bytes()))
-		{
+	if op.rpc != nil {
+		if err := api.callFunction(txn, op.rpc, scope, req.output); err != nil {
+			return rollback(err)
+		}
+	}
+
+	if op.copyFrom != nil {
+		count, err := op.copyFrom.run(txn, templateParams, req.csvBody)
+		if err != nil {
+			log.Println("Failed to copy rows", err)
+			return rollback(errorMapping(err))
+		}
+		if len(op.queries) == 0 && req.output != nil {
+			if err := req.output.Begin([]string{"rows"}); err != nil {
+				return rollback(err)
+			}
+			if err := req.output.Encode(map[string]interface{}{"rows": count}); err != nil {
+				return rollback(err)
+			}
+		}
+	}
+
+	for i, query := range op.queries {
+		last := i == len(op.queries)-1
+		var output encoder
+		var results *collector
+		if last {
+			output = req.output
+		} else if query.as != "" {
+			results = &collector{}
+			output = results
+		}
+
+		items := []interface{}{nil}
+		if query.forEach != nil {
 			var err error
-			if i < len(queryTemplates)-1 {
-				_, err = txn.NamedExec(
-					string(queryBuffer.Bytes()),
-					queryParams,
-				)
-			} else {
-				rows, err = txn.NamedQuery(
-					string(queryBuffer.Bytes()),
-					queryParams,
-				)
+			if items, err = query.items(scope); err != nil {
+				log.Println("Failed to find forEach items", err)
+				return rollback(err)
 			}
-			if err != nil {
-				log.Println("Failed to run query", err)
-				if err := txn.Rollback(); err != nil {
-					log.Fatal(err)
+		}
+		var withoutRows map[string]interface{}
+		if query.batch {
+			rows, _ := templateParams["rows"].([]interface{})
+			items = batches(rows, dialect)
+			withoutRows = map[string]interface{}{}
+			for key, val := range queryParams {
+				if !strings.HasPrefix(key, "rows.") {
+					withoutRows[key] = val
 				}
-				return nil, errorMapping(err)
 			}
 		}
-	}
 
-	var results []map[string]interface{}
-	row := map[string]interface{}{}
-	for rows.Next() {
-		if err := rows.MapScan(row); err != nil {
-			log.Println("Failed to scan row", err)
-			if err := rows.Close(); err != nil {
-				log.Fatal(err)
+		for _, item := range items {
+			params, batchTemplateParams := queryParams, templateParams
+			if query.forEach != nil {
+				params = bindItem(query.item, item, dialect, queryParams)
+				scope[query.item] = item
+			} else if query.batch {
+				params, batchTemplateParams = bindBatch(item.([]interface{}), dialect, withoutRows, templateParams)
+			}
+
+			if ok, err := query.enabled(scope); err != nil {
+				log.Println("Failed to evaluate when", err)
+				return rollback(err)
+			} else if !ok {
+				continue
+			}
+
+			if last && req.export != nil {
+				if err := api.export(txn, query, batchTemplateParams, params, op.copyTo, req.export); err != nil {
+					return rollback(err)
+				}
+			} else if err := api.execQuery(txn, query, batchTemplateParams, params, output); err != nil {
+				return rollback(err)
 			}
-			return nil, echo.NewHTTPError(http.StatusInternalServerError, err)
 		}
-		results = append(results, row)
-	}
-	if err := rows.Err(); err != nil {
-		log.Println("Failed to fetch rows", err)
-		return nil, errorMapping(err)
+		if query.forEach != nil {
+			delete(scope, query.item)
+		}
+
+		if results != nil {
+			bindResult(query.as, results.rows, templateParams, queryParams)
+			if !op.strict {
+				bound := map[string]interface{}{query.as: templateParams[query.as]}
+				if err := sanitize(bound); err != nil {
+					log.Println("Failed to bind result", query.as, err)
+					return rollback(err)
+				}
+			}
+			scope[query.as] = templateParams[query.as]
+		}
 	}
-	if err := rows.Close(); err != nil {
-		log.Fatal(err)
+
+	if req.export != nil {
+		if err := req.export.Close(); err != nil {
+			log.Println("Failed to write export", err)
+			return rollback(err)
+		}
+	} else if raw, ok := req.output.(endTxnEncoder); ok {
+		if err := raw.EndTxn(txn); err != nil {
+			log.Println("Failed to write results", err)
+			return rollback(err)
+		}
+	} else if err := req.output.End(); err != nil {
+		log.Println("Failed to write results", err)
+		return rollback(err)
 	}
 
-	if err := api.resetUser(txn); err != nil {
+	if err := op.settings.resetUser(txn); err != nil {
 		log.Println("Failed to reset role", err)
-		if err := txn.Rollback(); err != nil {
-			log.Fatal(err)
-		}
-		return nil, echo.NewHTTPError(http.StatusUnauthorized, err)
+		return rollback(echo.NewHTTPError(http.StatusUnauthorized, err))
 	}
 	if err := txn.Commit(); err != nil {
-		log.Fatal(err)
+		log.Println("Failed to commit", err)
+		return errorMapping(err)
+	}
+	if op.modifies {
+		api.RefreshCatalog()
 	}
 
-	return results, nil
+	return nil
 }
@@ -1,16 +1,40 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"text/template"
 	"time"
 
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/ipc"
 	"github.com/cockroachdb/cockroach-go/v2/testserver"
+	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
 type TestResponse func(t *testing.T, rec *httptest.ResponseRecorder)
@@ -67,12 +91,12 @@ func TestGets(t *testing.T) {
 			http.StatusUnauthorized, "nonexistant", "test", NoTest,
 		},
 		{
-			httptest.NewRequest(http.MethodDelete, "/_data/postgres/public/testtable", nil),
+			httptest.NewRequest(http.MethodDelete, "/_ddl/postgres/public/testtable", nil),
 			http.StatusOK, "test", "test", NoTest,
 		},
 		{
 			httptest.NewRequest(
-				http.MethodPut, "/_data/postgres/public/testtable",
+				http.MethodPut, "/_ddl/postgres/public/testtable",
 				strings.NewReader(
 					`{"col": "real"}`,
 				),
@@ -93,7 +117,7 @@ func TestGets(t *testing.T) {
 			http.StatusOK, "test", "test", NoTest,
 		},
 		{
-			httptest.NewRequest(http.MethodDelete, "/_data/postgres/public/testtable", nil),
+			httptest.NewRequest(http.MethodDelete, "/_ddl/postgres/public/testtable", nil),
 			http.StatusOK, "test", "test", NoTest,
 		},
 		{
@@ -112,7 +136,7 @@ func TestGets(t *testing.T) {
 		// Create table as newuser
 		{
 			httptest.NewRequest(
-				http.MethodPut, "/_data/postgres/public/testtable",
+				http.MethodPut, "/_ddl/postgres/public/testtable",
 				strings.NewReader(
 					`{"col": "real"}`,
 				),
@@ -188,6 +212,7 @@ func Test_convertPath(t *testing.T) {
 		{"{apple}", ":apple"},
 		{"/{apple}/{pear}", "/:apple/:pear"},
 		{"/base/{apple}", "/base/:apple"},
+		{"/orders/{order_id}", "/orders/:order_id"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
@@ -197,3 +222,2351 @@ func Test_convertPath(t *testing.T) {
 		})
 	}
 }
+
+type HTTPTest struct {
+	req     *http.Request
+	status  int
+	recTest TestResponse
+}
+
+func runHTTPTests(t *testing.T, server http.Handler, tests []HTTPTest) {
+	for _, test := range tests {
+		t.Run(
+			fmt.Sprintf("%s %s", test.req.Method, test.req.RequestURI),
+			func(t *testing.T) {
+				if test.req.Header.Get("Content-Type") == "" {
+					test.req.Header.Set("Content-Type", "application/json")
+				}
+				rec := httptest.NewRecorder()
+				server.ServeHTTP(rec, test.req)
+				if test.status != rec.Code {
+					t.Errorf(
+						"HTTP Code mismatch %d != %d : %s",
+						test.status, rec.Code, rec.Body.String(),
+					)
+				}
+				test.recTest(t, rec)
+			},
+		)
+	}
+}
+
+func gzipRequest(target string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	return req
+}
+
+func acceptRequest(target string, accept string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Accept", accept)
+	return req
+}
+
+func newSqliteAPI(t *testing.T, name string, setup ...string) *API {
+	api := NewApi("jdbc:sqlite3://" + name)
+	for _, stmt := range setup {
+		if _, err := api.sql.NamedExec(stmt, map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return api
+}
+
+func TestPipelines(t *testing.T) {
+	api := newSqliteAPI(t, "pipelines",
+		"CREATE TABLE orders (id INTEGER PRIMARY KEY, customer TEXT NOT NULL, note TEXT)",
+		"CREATE TABLE order_lines (order_id INTEGER, sku TEXT, qty INTEGER)",
+	)
+	server := api.GetServer("./orders.openapi.yml")
+
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			httptest.NewRequest(
+				http.MethodPost, "/orders",
+				strings.NewReader(`{"customer": "alice", "lines": [{"sku": "apple", "qty": 1}]}`),
+			),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 1 || target[0]["order_id"] != 1.0 || target[0]["sku"] != "apple" {
+					t.Error("Order line should reference the new order not", target)
+				}
+			},
+		},
+		{
+			httptest.NewRequest(
+				http.MethodPost, "/orders",
+				strings.NewReader(`{
+					"customer": "bob", "note": "fragile",
+					"lines": [{"sku": "pear", "qty": 2}, {"sku": "plum", "qty": 0}, {"sku": "fig", "qty": 3}]
+				}`),
+			),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 2 || target[0]["order_id"] != 2.0 {
+					t.Error("Should have inserted two lines for the second order not", target)
+				}
+			},
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/orders", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 2 || target[0]["note"] != nil || target[1]["note"] != "fragile" {
+					t.Error("Only the second order should have a note not", target)
+				}
+			},
+		},
+		{
+			httptest.NewRequest(
+				http.MethodPost, "/orders",
+				strings.NewReader(`{"customer": "carol", "lines": "apple"}`),
+			),
+			http.StatusBadRequest, NoTest,
+		},
+		{
+			acceptRequest("/orders/count", "text/plain"),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if rec.Body.String() != "2" {
+					t.Error("Should have counted two orders not", rec.Body.String())
+				}
+			},
+		},
+		{acceptRequest("/orders/count", "text/csv"), http.StatusNotAcceptable, NoTest},
+		{
+			gzipRequest("/orders/export?customer=alice"),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				reader, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := ioutil.ReadAll(reader)
+				if string(body) != "id,customer,note\n2,bob,fragile\n" {
+					t.Error("Unexpected export", string(body))
+				}
+			},
+		},
+	})
+}
+
+func TestCopyFrom(t *testing.T) {
+	api := newSqliteAPI(t, "copyfrom",
+		"CREATE TABLE orders (id INTEGER PRIMARY KEY, customer TEXT NOT NULL, note TEXT, \"delivery\nnote\" TEXT)",
+	)
+	server := api.GetServer("./orders.openapi.yml")
+
+	csvRequest := func(body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/orders/import", strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/csv")
+		return req
+	}
+	failingLine := func(line float64) TestResponse {
+		return func(t *testing.T, rec *httptest.ResponseRecorder) {
+			target := map[string]interface{}{}
+			json.NewDecoder(rec.Body).Decode(&target)
+			if target["line"] != line {
+				t.Error("Should have reported line", line, "not", target)
+			}
+		}
+	}
+
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			csvRequest("customer,note\nalice,\nbob,\"fragile, handle with care\"\nerin,\"\"\n"),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 1 || target[0]["rows"] != 3.0 {
+					t.Error("Should have copied three rows not", target)
+				}
+			},
+		},
+		{csvRequest("customer,note\ncarol,\n,missing\n"), http.StatusConflict, failingLine(3)},
+		{csvRequest("customer,note\ncarol,a,b\n"), http.StatusBadRequest, failingLine(2)},
+		// The quoted header spans two lines
+		{csvRequest("customer,\"delivery\nnote\"\ndave,door\n,x\n"), http.StatusConflict, failingLine(4)},
+		{
+			httptest.NewRequest(http.MethodPost, "/orders/import", strings.NewReader(`{}`)),
+			http.StatusUnsupportedMediaType, NoTest,
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/orders", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 3 || target[0]["note"] != nil || target[1]["note"] != "fragile, handle with care" ||
+					target[2]["note"] != "" {
+					t.Error("Only the first import should have been committed not", target)
+				}
+			},
+		},
+	})
+}
+
+func Test_readCSV(t *testing.T) {
+	tests := []struct {
+		input   string
+		fields  int
+		records [][]interface{}
+		lines   []int
+		err     error
+	}{
+		{"a,,\"\"\n", 3, [][]interface{}{{"a", nil, ""}}, []int{1}, nil},
+		{
+			"\"x\ny\",\"a \"\"b\"\"\"\r\n\nc,d", 2,
+			[][]interface{}{{"x\ny", `a "b"`}, {"c", "d"}}, []int{1, 4}, nil,
+		},
+		{"a,b\nc\n", 2, [][]interface{}{{"a", "b"}}, []int{1}, csv.ErrFieldCount},
+		{"a,b\"c\n", 2, [][]interface{}{}, []int{}, csv.ErrBareQuote},
+		{"\"a\"b,c\n", 2, [][]interface{}{}, []int{}, csv.ErrQuote},
+		{"\"a,b\n", 2, [][]interface{}{}, []int{}, csv.ErrQuote},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			records, lines := [][]interface{}{}, []int{}
+			err := readCSV(strings.NewReader(tt.input), tt.fields, func(line int, record []interface{}) error {
+				records = append(records, record)
+				lines = append(lines, line)
+				return nil
+			})
+			if tt.err == nil && err != nil {
+				t.Error(err)
+			} else if copyerr, ok := err.(copyError); tt.err != nil && (!ok || !errors.Is(copyerr.err, tt.err)) {
+				t.Error("Should have failed with", tt.err, "not", err)
+			}
+			if !reflect.DeepEqual(records, tt.records) || !reflect.DeepEqual(lines, tt.lines) {
+				t.Error("Unexpected records", records, lines)
+			}
+		})
+	}
+}
+
+func TestSqlite(t *testing.T) {
+	api := newSqliteAPI(t, "sqlite",
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT DEFAULT 'unnamed')",
+	)
+	server := api.GetServer("./sqlite3.openapi.yml")
+
+	// More params than the SQLite limit of 999, with an explicit null
+	manyRows := []string{`{"id": 10, "name": null}`}
+	for i := 11; i < 1010; i++ {
+		manyRows = append(manyRows, fmt.Sprintf(`{"id": %d}`, i))
+	}
+	many := "[" + strings.Join(manyRows, ", ") + "]"
+
+	upsert := httptest.NewRequest(
+		http.MethodPost, "/_data/items?on_conflict=id",
+		strings.NewReader(`[{"id": 1, "name": "b"}, {"id": 3, "name": "c"}]`),
+	)
+	upsert.Header.Set("Prefer", "resolution=merge-duplicates")
+	upsertWithoutColumns := httptest.NewRequest(
+		http.MethodPost, "/_data/items",
+		strings.NewReader(`[{"id": 1, "name": "b"}]`),
+	)
+	upsertWithoutColumns.Header.Set("Prefer", "resolution=merge-duplicates")
+
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			httptest.NewRequest(
+				http.MethodPost, "/_data/items",
+				strings.NewReader(`[{"id": 1, "name": "a"}, {"id": 2}]`),
+			),
+			http.StatusOK, NoTest,
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/_data/items", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 2 || target[0]["name"] != "a" || target[1]["name"] != "unnamed" {
+					t.Error("Should have inserted both rows, defaulting the name, not", target)
+				}
+			},
+		},
+		{
+			httptest.NewRequest(
+				http.MethodPost, "/_data/items",
+				strings.NewReader(`{"id": 1, "name": "b"}`),
+			),
+			http.StatusConflict, NoTest,
+		},
+		{upsert, http.StatusOK, NoTest},
+		{upsertWithoutColumns, http.StatusBadRequest, NoTest},
+		{
+			httptest.NewRequest(http.MethodGet, "/_data/items", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 3 || target[0]["name"] != "b" || target[2]["name"] != "c" {
+					t.Error("Should have merged the duplicate row not", target)
+				}
+			},
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/_data/items?format=csv", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if rec.Body.String() != "id,name\n1,b\n2,unnamed\n3,c\n" {
+					t.Error("Unexpected CSV", rec.Body.String())
+				}
+			},
+		},
+		{
+			acceptRequest("/_data/items", "application/xml, application/x-ndjson;q=0.5"),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); len(lines) != 3 {
+					t.Error("Should have three NDJSON lines not", lines)
+				}
+			},
+		},
+		{
+			acceptRequest("/_data/items", "application/vnd.apache.arrow.stream"),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				reader, err := ipc.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer reader.Release()
+				rows := int64(0)
+				for reader.Next() {
+					rows += reader.Record().NumRows()
+				}
+				if rows != 3 || reader.Schema().Field(0).Type.ID() != arrow.INT64 {
+					t.Error("Unexpected Arrow stream", rows, reader.Schema())
+				}
+			},
+		},
+		{
+			acceptRequest("/_data/items", "text/*"),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if rec.Header().Get(echo.HeaderContentType) != mimeCSV {
+					t.Error("text/* should match CSV not", rec.Header())
+				}
+			},
+		},
+		{
+			acceptRequest("/_data/items", "application/*;q=0.9, text/csv;q=0.5"),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if !strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+					t.Error("application/* should match JSON not", rec.Header())
+				}
+			},
+		},
+		{acceptRequest("/_data/items", "text/plain"), http.StatusNotAcceptable, NoTest},
+		{acceptRequest("/_data/items", "image/*"), http.StatusNotAcceptable, NoTest},
+		{acceptRequest("/_data/items?format=xml", ""), http.StatusNotAcceptable, NoTest},
+		{
+			httptest.NewRequest(http.MethodPost, "/_data/items", strings.NewReader(`[]`)),
+			http.StatusBadRequest, NoTest,
+		},
+		{
+			httptest.NewRequest(http.MethodPost, "/_data/items", strings.NewReader(`[1, 2]`)),
+			http.StatusBadRequest, NoTest,
+		},
+		{
+			httptest.NewRequest(http.MethodPost, "/_data/items", strings.NewReader(many)),
+			http.StatusOK, NoTest,
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/_data/items", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 3+len(manyRows) || target[3]["name"] != nil || target[4]["name"] != "unnamed" {
+					t.Error("Should have inserted every row in batches not", len(target), target[3:5])
+				}
+			},
+		},
+	})
+}
+
+func Test_batches(t *testing.T) {
+	rows, err := bodyRows([]interface{}{
+		map[string]interface{}{"id": 1.0, "name": "a"},
+		map[string]interface{}{"id": 2.0, "name": "b"},
+		map[string]interface{}{"id": 3.0},
+		map[string]interface{}{"id": 4.0, "name": nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := batches(rows, "postgres")
+	if len(got) != 3 {
+		t.Fatal("Should split the rows by their keys not", got)
+	}
+	if row := got[1].([]interface{})[0].(map[string]interface{}); len(row) != 1 {
+		t.Error("Should leave out the defaulted name not", row)
+	}
+	if row := got[2].([]interface{})[0].(map[string]interface{}); len(row) != 2 || row["name"] != nil {
+		t.Error("Should keep the null name not", row)
+	}
+
+	rows = make([]interface{}, 1000)
+	for i := range rows {
+		rows[i] = map[string]interface{}{"id": float64(i), "name": "a"}
+	}
+	got = batches(rows, "sqlite3")
+	if len(got) != 3 || len(got[0].([]interface{})) != 450 {
+		t.Error("Should keep the params of a batch under the SQLite limit not", len(got))
+	}
+}
+
+func Test_arrowEncoder(t *testing.T) {
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	output := &arrowEncoder{w: c.Response()}
+	output.Begin([]string{"n", "mixed", "empty"})
+	// The float and the text only show up after the first batch
+	for i := 0; i <= arrowBatchSize; i++ {
+		output.Encode(map[string]interface{}{"n": int64(i), "mixed": int64(i), "empty": nil})
+	}
+	output.Encode(map[string]interface{}{"n": 1.5, "mixed": "x", "empty": nil})
+	if err := output.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := ipc.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Release()
+	rows := int64(0)
+	for reader.Next() {
+		rows += reader.Record().NumRows()
+	}
+	types := []arrow.Type{}
+	for _, field := range reader.Schema().Fields() {
+		types = append(types, field.Type.ID())
+	}
+	if rows != arrowBatchSize+2 || !reflect.DeepEqual(types, []arrow.Type{arrow.FLOAT64, arrow.STRING, arrow.STRING}) {
+		t.Error("Unexpected Arrow stream", rows, types)
+	}
+}
+
+func Test_inlineParams(t *testing.T) {
+	tests := []struct {
+		input  string
+		params map[string]interface{}
+		output string
+	}{
+		{"SELECT :a", map[string]interface{}{"a": "it's"}, "SELECT 'it''s'"},
+		{"SELECT :a, :b", map[string]interface{}{"a": 1, "b": nil}, "SELECT 1, NULL"},
+		{"SELECT length(:a)", map[string]interface{}{"a": []byte("hi")}, `SELECT length('\x6869'::bytea)`},
+		{"SELECT :a.b + :c", map[string]interface{}{"a.b": 1.5, "c": true}, "SELECT 1.5 + TRUE"},
+		{"SELECT '$1', :a, $$ $2 $$", map[string]interface{}{"a": "$1"}, "SELECT '$1', '$1', $$ $2 $$"},
+		{"SELECT :a, '12::30', :a_", map[string]interface{}{"a": 1}, "SELECT 1, '12:30', 1_"},
+		{"SELECT :a = ANY(:b)", map[string]interface{}{"a": "x", "b": pq.Array([]string{"x", "y"})}, `SELECT 'x' = ANY('{"x","y"}')`},
+		{"SELECT 1 WHERE TRUE:", map[string]interface{}{}, "SELECT 1 WHERE TRUE:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got, err := inlineParams(tt.input, tt.params); err != nil || got != tt.output {
+				t.Errorf("inlineParams() = %v, %v want %v", got, err, tt.output)
+			}
+		})
+	}
+}
+
+func Test_acceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"gzip": true, "deflate, gzip;q=0.5": true, "GZIP": true,
+		"": false, "gzip;q=0": false, "gzip; q=0, deflate": false, "x-gzip-like": false,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v want %v", header, got, want)
+		}
+	}
+}
+
+func Test_templateFuncs(t *testing.T) {
+	rows := []interface{}{map[string]interface{}{"name": "it's", "a b": 1}}
+	tests := []struct {
+		driver string
+		input  string
+		params map[string]interface{}
+		output string
+	}{
+		{"pgx", `{{ident .t}}`, map[string]interface{}{"t": `x"; DROP TABLE y`}, `"x""; DROP TABLE y"`},
+		{"pgx", `{{qualified .d .s .t}}`, map[string]interface{}{"d": "db", "s": "public", "t": "T"}, `"db"."public"."T"`},
+		{"pgx", `{{literal .v}}`, map[string]interface{}{"v": "it's"}, `'it''s'`},
+		{"pgx", `{{literal .v}}`, map[string]interface{}{"v": "12:30"}, `'12::30'`},
+		{"pgx", `{{literal .v}}`, map[string]interface{}{"v": []byte{1}}, `'\x01'::::bytea`},
+		{"pgx", `{{ident .t}}`, map[string]interface{}{"t": "a:b"}, `"a::b"`},
+		{"sqlite3", `{{literal .v}}`, map[string]interface{}{"v": true}, `1`},
+		{"sqlite3", `{{literal .v}}`, map[string]interface{}{"v": `a\'`}, `'a\'''`},
+		{"pgx", `{{join ", " .cols}}`, map[string]interface{}{"cols": []string{"a", "b"}}, `"a", "b"`},
+		{"pgx", `{{columns .rows}}`, map[string]interface{}{"rows": rows}, `"a b", "name"`},
+		{"pgx", `{{placeholders .row "rows.0"}}`, map[string]interface{}{"row": map[string]interface{}{"b": 1, "a": 2}}, `:rows.0.a, :rows.0.b`},
+		{"pgx", `{{assign .row "rows.0"}}`, map[string]interface{}{"row": map[string]interface{}{"b": 1, "a": 2}}, `"a" = :rows.0.a, "b" = :rows.0.b`},
+		{"pgx", `{{placeholders .row "rows.0"}}`, map[string]interface{}{"row": map[string]interface{}{"b": defaultValue{}, "a": 2}}, `:rows.0.a, DEFAULT`},
+		{"pgx", `{{oneOf .v "select" "insert"}}`, map[string]interface{}{"v": "Insert"}, `INSERT`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var buffer bytes.Buffer
+			tmpl := template.Must(template.New("test").Funcs(dialectOf(tt.driver).funcs()).Parse(tt.input))
+			if err := tmpl.Execute(&buffer, tt.params); err != nil || buffer.String() != tt.output {
+				t.Errorf("%s = %v, %v want %v", tt.input, buffer.String(), err, tt.output)
+			}
+		})
+	}
+
+	for _, input := range []string{
+		`{{placeholders .row}}`, `{{assign .row}}`, `{{oneOf .v "select"}}`, `{{ident .v}}`,
+		`{{placeholders .ok .v}}`, `{{assign .ok "rows.0, 1"}}`,
+	} {
+		tmpl := template.Must(template.New("test").Funcs(dialectOf("pgx").funcs()).Parse(input))
+		err := tmpl.Execute(ioutil.Discard, map[string]interface{}{
+			"row": map[string]interface{}{"a; DROP": 1}, "v": "", "ok": map[string]interface{}{"a": 1},
+		})
+		if err == nil {
+			t.Error(input, "should fail")
+		}
+	}
+}
+
+func TestLiteralColons(t *testing.T) {
+	api := newSqliteAPI(t, "colons")
+	var buffer bytes.Buffer
+	tmpl := template.Must(template.New("test").Funcs(dialectOf("sqlite3").funcs()).Parse(
+		`SELECT {{literal .time}} AS {{ident .column}}, {{literal .url}} AS url, :id AS id`,
+	))
+	err := tmpl.Execute(&buffer, map[string]interface{}{"time": "12:30", "url": "http://x/:id", "column": "a:b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := api.sql.NamedQuery(buffer.String(), map[string]interface{}{"id": 7})
+	if err != nil {
+		t.Fatal(buffer.String(), err)
+	}
+	defer rows.Close()
+	row := map[string]interface{}{}
+	if !rows.Next() || rows.MapScan(row) != nil {
+		t.Fatal("Should have read a row", rows.Err())
+	}
+	if formatValue(row["a:b"]) != "12:30" || formatValue(row["url"]) != "http://x/:id" || formatValue(row["id"]) != "7" {
+		t.Error("Colons should survive the named params not", row)
+	}
+}
+
+func Test_checkStrict(t *testing.T) {
+	tests := []struct {
+		input string
+		valid bool
+	}{
+		{`SELECT * FROM {{ident .table}} WHERE id = :id`, true},
+		{`{{$first := true}}{{range $col, $val := .body}}{{if $first}}{{$first = false}}{{else}},{{end}}{{ident $col}}{{end}}`, true},
+		{`{{with .v}}{{. | literal}}{{end}}`, true},
+		{`SELECT * FROM {{.table}}`, false},
+		{`{{if .v}}{{ident .v}}{{else}}{{.v}}{{end}}`, false},
+		{`{{range .cols}}{{printf "%s" .}}{{end}}`, false},
+		{`{{join ", " .cols}}`, true},
+		{`{{.cols | join " AND "}}`, true},
+		{`{{oneOf .action "select" "insert"}}`, true},
+		{`{{join .body.sep .cols}}`, false},
+		{`{{.cols | join .sep}}`, false},
+		{`{{ident (join .sep .cols)}}`, false},
+		{`{{$s := join .sep .cols}}{{ident $s}}`, false},
+		{`{{if join .sep .cols}}{{end}}`, false},
+		{`{{oneOf .action .allowed}}`, false},
+		{`{{.allowed | oneOf .action}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			tmpl := template.Must(template.New("test").Funcs(dialectOf("pgx").funcs()).Parse(tt.input))
+			if err := checkStrict(tmpl); (err == nil) != tt.valid {
+				t.Errorf("checkStrict() = %v want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestStrictTemplates(t *testing.T) {
+	server := newSqliteAPI(t, "strict").GetServer("./sqlite3.openapi.yml")
+
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			httptest.NewRequest(
+				http.MethodPut, "/_ddl/notes",
+				strings.NewReader(`{"id": "real", "note": "text"}`),
+			),
+			http.StatusOK, NoTest,
+		},
+		{
+			httptest.NewRequest(
+				http.MethodPut, "/_ddl/evil",
+				strings.NewReader(`{"id": "real); DROP TABLE notes; --"}`),
+			),
+			http.StatusBadRequest, NoTest,
+		},
+		{
+			httptest.NewRequest(
+				http.MethodPost, "/_data/notes",
+				strings.NewReader(`{"id": 1, "note": "it's; DROP TABLE notes"}`),
+			),
+			http.StatusOK, NoTest,
+		},
+		{
+			httptest.NewRequest(
+				http.MethodPost, "/_data/notes",
+				strings.NewReader(`{"id": 2, "note text": "x"}`),
+			),
+			http.StatusBadRequest, NoTest,
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/_data/notes", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 1 || target[0]["note"] != "it's; DROP TABLE notes" {
+					t.Error("Should have kept the notes table not", target)
+				}
+			},
+		},
+	})
+}
+
+func TestIdentifiers(t *testing.T) {
+	api := newSqliteAPI(t, "identifiers",
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)",
+	)
+	server := api.GetServer("./sqlite3.openapi.yml")
+
+	runHTTPTests(t, server, []HTTPTest{
+		{httptest.NewRequest(http.MethodGet, "/_data/items", nil), http.StatusOK, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/_data/missing", nil), http.StatusNotFound, NoTest},
+		{
+			httptest.NewRequest(
+				http.MethodPost, "/_data/missing", strings.NewReader(`{"id": 1}`),
+			),
+			http.StatusNotFound, NoTest,
+		},
+		// Creating the table through the API refreshes the catalog
+		{
+			httptest.NewRequest(
+				http.MethodPut, "/_ddl/missing", strings.NewReader(`{"id": "real"}`),
+			),
+			http.StatusOK, NoTest,
+		},
+		{httptest.NewRequest(http.MethodGet, "/_data/missing", nil), http.StatusOK, NoTest},
+	})
+
+	// Tables created elsewhere stay unknown until the cache is refreshed
+	if _, err := api.sql.NamedExec("CREATE TABLE later (id INTEGER)", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	runHTTPTests(t, server, []HTTPTest{
+		{httptest.NewRequest(http.MethodGet, "/_data/later", nil), http.StatusNotFound, NoTest},
+	})
+	api.RefreshCatalog()
+	runHTTPTests(t, server, []HTTPTest{
+		{httptest.NewRequest(http.MethodGet, "/_data/later", nil), http.StatusOK, NoTest},
+	})
+
+	txn, err := api.sql.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Rollback()
+	names, err := api.catalog.names(txn, defaultCatalogTTL, catalogQueries["sqlite3"]["column"], "anon", "column")
+	if err != nil || !names["main.items.name"] || !names["items.name"] || names["items.missing"] {
+		t.Error("Unexpected column names", names, err)
+	}
+}
+
+func Test_identifierKey(t *testing.T) {
+	params := map[string]interface{}{"schema": "public", "table": "orders", "column": "id"}
+	tests := []struct {
+		identifier identifier
+		key        string
+	}{
+		{identifier{"table", grestIdentifier{Kind: "table"}}, "orders"},
+		{identifier{"table", grestIdentifier{Kind: "table", Schema: "schema"}}, "public.orders"},
+		{identifier{"column", grestIdentifier{Kind: "column", Schema: "schema", Table: "table"}}, "public.orders.id"},
+	}
+	for _, tt := range tests {
+		if key := tt.identifier.key(params); key != tt.key {
+			t.Errorf("key() = %v want %v", key, tt.key)
+		}
+	}
+
+	// Scopes missing from the operation fail instead of matching orders.id
+	missing := identifier{"column", grestIdentifier{Kind: "column", Schema: "missing", Table: "table"}}
+	declared := []openapi3.Parameter{{Name: "table"}, {Name: "column"}}
+	if err := checkScopes("GET /x", []identifier{missing}, declared); err == nil {
+		t.Error("checkScopes() should fail on the undeclared schema param")
+	}
+	declared = append(declared, openapi3.Parameter{Name: "missing"})
+	if err := checkScopes("GET /x", []identifier{missing}, declared); err != nil {
+		t.Error("checkScopes() =", err)
+	}
+}
+
+func Test_columnDefs(t *testing.T) {
+	body := map[string]interface{}{
+		"id":    map[string]interface{}{"type": "integer", "primaryKey": true},
+		"name":  map[string]interface{}{"type": "text", "nullable": false, "default": "it's"},
+		"owner": map[string]interface{}{"type": "integer", "references": map[string]interface{}{"table": "public.users", "column": "id"}},
+		"at":    "timestamp",
+	}
+	tests := []struct {
+		driver string
+		output string
+	}{
+		{"pgx", `"at" TIMESTAMPTZ,
+"id" INTEGER,
+"name" TEXT NOT NULL DEFAULT 'it''s',
+"owner" INTEGER REFERENCES "public"."users" ("id"),
+PRIMARY KEY ("id")`},
+		{"sqlite3", `"at" TIMESTAMP,
+"id" INTEGER,
+"name" TEXT NOT NULL DEFAULT 'it''s',
+"owner" INTEGER REFERENCES "public"."users" ("id"),
+PRIMARY KEY ("id")`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.driver, func(t *testing.T) {
+			if got, err := dialectOf(tt.driver).columnDefs(body); err != nil || string(got) != tt.output {
+				t.Errorf("columnDefs() = %v, %v want %v", got, err, tt.output)
+			}
+		})
+	}
+
+	types, err := allowedTypes("pgx", []string{"text", "json"})
+	if err != nil || types["json"] != "JSONB" || types["real"] != "" {
+		t.Error("Unexpected allowed types", types, err)
+	}
+	if _, err := allowedTypes("pgx", []string{"money"}); err == nil {
+		t.Error("Unknown types should not be allowed")
+	}
+	for _, bad := range []interface{}{
+		map[string]interface{}{"id": "json"},
+		map[string]interface{}{"id": map[string]interface{}{"type": "text; DROP TABLE x"}},
+		map[string]interface{}{"id": 1},
+		map[string]interface{}{},
+	} {
+		if _, err := dialectOf("sqlite3").columnDefs(bad); err == nil {
+			t.Error(bad, "should not be valid columns")
+		}
+	}
+}
+
+func TestColumnDefs(t *testing.T) {
+	server := newSqliteAPI(t, "columns", "PRAGMA foreign_keys = ON").GetServer("./sqlite3.openapi.yml")
+
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			httptest.NewRequest(
+				http.MethodPut, "/_ddl/customers",
+				strings.NewReader(`{"id": {"type": "integer", "primaryKey": true}, "name": "text"}`),
+			),
+			http.StatusOK, NoTest,
+		},
+		{
+			httptest.NewRequest(
+				http.MethodPut, "/_ddl/invoices",
+				strings.NewReader(`{
+					"id": {"type": "integer", "primaryKey": true},
+					"customer": {"type": "integer", "nullable": false, "references": "customers"},
+					"paid": {"type": "boolean", "default": false}
+				}`),
+			),
+			http.StatusOK, NoTest,
+		},
+		{
+			httptest.NewRequest(
+				http.MethodPost, "/_data/customers", strings.NewReader(`{"id": 1, "name": "a"}`),
+			),
+			http.StatusOK, NoTest,
+		},
+		{
+			httptest.NewRequest(
+				http.MethodPost, "/_data/invoices", strings.NewReader(`{"id": 1, "customer": 1}`),
+			),
+			http.StatusOK, NoTest,
+		},
+		{
+			httptest.NewRequest(
+				http.MethodPost, "/_data/invoices", strings.NewReader(`{"id": 2}`),
+			),
+			http.StatusConflict, NoTest,
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/_data/invoices", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 1 || target[0]["paid"] != false {
+					t.Error("Should have defaulted paid to false not", target)
+				}
+			},
+		},
+		{
+			httptest.NewRequest(
+				http.MethodPut, "/_ddl/blobs", strings.NewReader(`{"data": "bytes"}`),
+			),
+			http.StatusBadRequest, NoTest,
+		},
+	})
+}
+
+func Test_resolveExtension(t *testing.T) {
+	partials, refs, err := parseTemplates(json.RawMessage(`{
+		"table": "{{ident .table}}",
+		"drop": [{"sql": "DROP TABLE {{template \"table\" .}}"}],
+		"upsert": {"onConflict": ["id"], "queries": [{"sql": "INSERT"}]}
+	}`), dialectOf("sqlite3").funcs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partials.Lookup("table") == nil || len(refs) != 2 {
+		t.Fatal("Should have split partials from query lists", refs)
+	}
+
+	tests := []struct {
+		input   string
+		queries []string
+		valid   bool
+	}{
+		{`{"queries": [{"sql": "SELECT 1"}]}`, []string{"SELECT 1"}, true},
+		{`{"$ref": "#/components/x-grest-templates/drop"}`, []string{`DROP TABLE {{template "table" .}}`}, true},
+		{
+			`{"queries": [{"sql": "SELECT 1"}, {"$ref": "#/components/x-grest-templates/drop"}]}`,
+			[]string{"SELECT 1", `DROP TABLE {{template "table" .}}`}, true,
+		},
+		{`{"$ref": "#/components/x-grest-templates/upsert", "queries": [{"sql": "UPSERT"}]}`, []string{"UPSERT"}, true},
+		{`{"$ref": "#/components/x-grest-templates/missing"}`, nil, false},
+		{`{"queries": [{"$ref": "#/components/x-grest-templates/table"}]}`, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			ext, err := resolveExtension(json.RawMessage(tt.input), refs)
+			if (err == nil) != tt.valid {
+				t.Fatal("resolveExtension() error", err)
+			}
+			if !tt.valid {
+				return
+			}
+			if len(ext.Queries) != len(tt.queries) {
+				t.Fatal("Unexpected queries", ext.Queries)
+			}
+			for i, q := range ext.Queries {
+				if q.SQL != tt.queries[i] {
+					t.Error("Unexpected query", q.SQL, "want", tt.queries[i])
+				}
+			}
+		})
+	}
+
+	ext, _ := resolveExtension(json.RawMessage(`{"$ref": "#/components/x-grest-templates/upsert"}`), refs)
+	if len(ext.OnConflict) != 1 || ext.OnConflict[0] != "id" {
+		t.Error("Should keep the referenced onConflict", ext)
+	}
+}
+
+func Test_checkPartials(t *testing.T) {
+	partials, _, _ := parseTemplates(json.RawMessage(`{"table": "{{ident .table}}"}`), dialectOf("pgx").funcs())
+	for input, valid := range map[string]bool{
+		`SELECT * FROM {{template "table" .}}`:                  true,
+		`{{if .x}}SELECT * FROM {{template "tables" .}}{{end}}`: false,
+	} {
+		tmpl := template.Must(template.Must(partials.Clone()).New("test").Parse(input))
+		if err := checkPartials(tmpl); (err == nil) != valid {
+			t.Errorf("checkPartials(%s) = %v want valid %v", input, err, valid)
+		}
+		if err := checkStrict(tmpl); err != nil {
+			t.Error("Partials should be strict", err)
+		}
+	}
+}
+
+func TestBuiltinParams(t *testing.T) {
+	server := newSqliteAPI(t, "builtins").GetServer("./orders.openapi.yml")
+
+	whoami := httptest.NewRequest(http.MethodGet, "/whoami", strings.NewReader(`{"_user": "admin"}`))
+	whoami.Header.Set("X-Tenant", "it's acme")
+	whoami.Header.Set(echo.HeaderXRequestID, "req-1")
+	whoami.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	// Without trusted proxies, forwarding headers are ignored
+	whoami.Header.Set(echo.HeaderXForwardedFor, "203.0.113.9")
+	whoami.Header.Set(echo.HeaderXRealIP, "203.0.113.9")
+	spoofed := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	spoofed.Header.Set(echo.HeaderXRequestID, "'; DROP TABLE orders; --")
+
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			whoami, http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 1 {
+					t.Fatal("Expected a single row not", target)
+				}
+				row := target[0]
+				if row["user"] != "anon" || row["quoted_user"] != "anon" {
+					t.Error("The body should not override _user", row)
+				}
+				if row["tenant"] != "it's acme" || row["quoted_tenant"] != "it's acme" || row["session"] != "abc" {
+					t.Error("Should bind header and cookie params", row)
+				}
+				if row["request_id"] != "req-1" || rec.Header().Get(echo.HeaderXRequestID) != "req-1" {
+					t.Error("Should use the request id of the client", row)
+				}
+				if row["remote_ip"] != "192.0.2.1" || row["now"] == nil {
+					t.Error("Should bind the remote ip and time", row)
+				}
+			},
+		},
+		{
+			spoofed, http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if id := rec.Header().Get(echo.HeaderXRequestID); len(id) != 32 {
+					t.Error("Should replace invalid request ids not", id)
+				}
+			},
+		},
+	})
+
+	spec := `{
+		"openapi": "3.0.2",
+		"info": {"title": "proxied", "version": "1.0"},
+		"x-grest-trusted-proxies": ["192.0.2.0/24"],
+		"paths": {
+			"/ip": {
+				"get": {
+					"responses": {"200": {"description": "OK"}},
+					"x-grest": {"queries": [{"sql": "SELECT :_remote_ip AS ip"}]}
+				}
+			}
+		}
+	}`
+	path := t.TempDir() + "/proxied.json"
+	if err := ioutil.WriteFile(path, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	proxied := newSqliteAPI(t, "proxied").GetServer(path)
+	for remote, want := range map[string]string{"192.0.2.1:1234": "203.0.113.9", "198.51.100.1:1234": "198.51.100.1"} {
+		req := httptest.NewRequest(http.MethodGet, "/ip", nil)
+		req.RemoteAddr = remote
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.9")
+		rec := httptest.NewRecorder()
+		proxied.ServeHTTP(rec, req)
+		if rec.Body.String() != `[{"ip":"`+want+`"}`+"\n]\n" {
+			t.Error("Request from", remote, "should have remote ip", want, "not", rec.Body.String())
+		}
+	}
+
+	// Templates that aren't strict can't print them, as sanitize refuses them
+	for _, sql := range []string{"SELECT {{._now}}", "SELECT {{if $._user}}1{{end}}", "SELECT {{len (print ._remote_ip)}}"} {
+		spec := `{
+			"openapi": "3.0.2",
+			"info": {"title": "loose", "version": "1.0"},
+			"paths": {"/now": {"get": {
+				"responses": {"200": {"description": "OK"}},
+				"x-grest": {"queries": [{"sql": "` + sql + `"}]}
+			}}}
+		}`
+		if err := ioutil.WriteFile(path, []byte(spec), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newSqliteAPI(t, "loose").LoadServer(path); err == nil || !strings.Contains(err.Error(), "bind it as :_") {
+			t.Error(sql, "should be refused not", err)
+		}
+	}
+}
+
+func TestNestedBody(t *testing.T) {
+	server := newSqliteAPI(t, "nested",
+		"CREATE TABLE customers (name TEXT, city TEXT, address TEXT, tags TEXT, first_tag TEXT)",
+	).GetServer("./orders.openapi.yml")
+
+	body := `{"address":{"city":"Dublin","zip":"D01"},"name":"alice","tags":["vip","wholesale"]}`
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			httptest.NewRequest(http.MethodPost, "/customers", strings.NewReader(body)),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				if len(target) != 1 {
+					t.Fatal("Expected the new customer not", target)
+				}
+				row := target[0]
+				if row["city"] != "Dublin" || row["first_tag"] != "vip" {
+					t.Error("Should bind nested values not", row)
+				}
+				if row["address"] != `{"city":"Dublin","zip":"D01"}` || row["tags"] != `["vip","wholesale"]` {
+					t.Error("Should bind objects and arrays as JSON not", row)
+				}
+				if row["body"] != body {
+					t.Error("Should bind the whole body as _body not", row["body"])
+				}
+			},
+		},
+	})
+}
+
+func Test_paramValue(t *testing.T) {
+	array, err := paramValue([]interface{}{1.0, "a,b", nil}, "postgres").(driver.Valuer).Value()
+	if err != nil || array != `{1,"a,b",NULL}` {
+		t.Error("Should bind scalar arrays as Postgres arrays not", array, err)
+	}
+	if value := paramValue([]interface{}{map[string]interface{}{"a": 1.0}}, "postgres"); value != `[{"a":1}]` {
+		t.Error("Should bind arrays of objects as JSON not", value)
+	}
+	if value := paramValue([]interface{}{1.0, 2.0}, "sqlite3"); value != `[1,2]` {
+		t.Error("Should bind arrays as JSON on SQLite not", value)
+	}
+	if value := paramValue(map[string]interface{}{"city": "Dublin"}, "sqlite3"); value != `{"city":"Dublin"}` {
+		t.Error("Should bind objects as JSON not", value)
+	}
+
+	params := map[string]interface{}{}
+	bodyParams(map[string]interface{}{
+		"address": map[string]interface{}{"city": "Dublin", "lines": []interface{}{"1 Main St"}},
+	}, "sqlite3", params)
+	if params["address.city"] != "Dublin" || params["address.lines.0"] != "1 Main St" ||
+		params["_body"] != `{"address":{"city":"Dublin","lines":["1 Main St"]}}` {
+		t.Error("Unexpected body params", params)
+	}
+}
+
+func multipartRequest(target string, owner string, filename string, content string) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("owner", owner)
+	part, _ := writer.CreateFormFile("file", filename)
+	part.Write([]byte(content))
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set(echo.HeaderContentType, writer.FormDataContentType())
+	return req
+}
+
+func TestUploads(t *testing.T) {
+	server := newSqliteAPI(t, "uploads",
+		"CREATE TABLE files (name TEXT, content_type TEXT, size INTEGER, content BLOB, owner TEXT)",
+	).GetServer("./orders.openapi.yml")
+
+	raw := httptest.NewRequest(http.MethodPost, "/files?owner=bob", strings.NewReader("\x00\x01raw"))
+	raw.Header.Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	raw.Header.Set(echo.HeaderContentDisposition, `attachment; filename="raw.bin"`)
+	large := httptest.NewRequest(http.MethodPost, "/files/large", strings.NewReader("large"))
+	large.Header.Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	fields := func(names ...string) *http.Request {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		for _, name := range names {
+			writer.WriteField(name, "x")
+		}
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/files", &body)
+		req.Header.Set(echo.HeaderContentType, writer.FormDataContentType())
+		return req
+	}
+
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			multipartRequest("/files", "alice", "hello.txt", "hello"),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				// BLOBs are base64 in JSON
+				if len(target) != 1 || target[0]["size"] != 5.0 || target[0]["content"] != "aGVsbG8=" ||
+					target[0]["content_type"] != echo.MIMEOctetStream || target[0]["owner"] != "alice" {
+					t.Error("Should store the uploaded file not", target)
+				}
+			},
+		},
+		{
+			raw, http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				target := []map[string]interface{}{}
+				json.NewDecoder(rec.Body).Decode(&target)
+				sum := sha256.Sum256([]byte("\x00\x01raw"))
+				if len(target) != 1 || target[0]["size"] != 5.0 || target[0]["name"] != "raw.bin" ||
+					target[0]["owner"] != "bob" || target[0]["sha256"] != hex.EncodeToString(sum[:]) {
+					t.Error("Should store the raw body as file not", target)
+				}
+			},
+		},
+		{
+			multipartRequest("/files", "alice", "big.txt", strings.Repeat("x", 17)),
+			http.StatusRequestEntityTooLarge, NoTest,
+		},
+		// Small parts are still limited in number and total size
+		{fields("a", "b", "c", "d"), http.StatusRequestEntityTooLarge, NoTest},
+		{fields(strings.Repeat("a", 400), strings.Repeat("b", 400), strings.Repeat("c", 400)), http.StatusRequestEntityTooLarge, NoTest},
+		{large, http.StatusNotImplemented, NoTest},
+	})
+
+	var etag string
+	ranged := httptest.NewRequest(http.MethodGet, "/files/hello.txt", nil)
+	ranged.Header.Set("Range", "bytes=1-2")
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			httptest.NewRequest(http.MethodGet, "/files/hello.txt", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if rec.Body.String() != "hello" || rec.Header().Get(echo.HeaderContentType) != echo.MIMEOctetStream ||
+					rec.Header().Get(echo.HeaderContentDisposition) != `attachment; filename=hello.txt` {
+					t.Error("Should serve the raw file not", rec.Header(), rec.Body.String())
+				}
+				etag = rec.Header().Get("ETag")
+			},
+		},
+		{
+			ranged, http.StatusPartialContent,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if rec.Body.String() != "el" || rec.Header().Get("Content-Range") != "bytes 1-2/5" {
+					t.Error("Should serve the range not", rec.Header(), rec.Body.String())
+				}
+			},
+		},
+		{httptest.NewRequest(http.MethodGet, "/files/missing", nil), http.StatusNotFound, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/files/hello.txt/large", nil), http.StatusNotImplemented, NoTest},
+	})
+
+	cached := httptest.NewRequest(http.MethodGet, "/files/hello.txt", nil)
+	cached.Header.Set("If-None-Match", etag)
+	runHTTPTests(t, server, []HTTPTest{{cached, http.StatusNotModified, NoTest}})
+}
+
+func Test_rpcFunction(t *testing.T) {
+	total := rpcFunction{
+		schema: "public", name: "order_total", required: 1, returnsRows: false, executable: true,
+		args: []rpcArg{{name: "order_id", typ: "integer"}, {name: "tax", typ: "numeric"}},
+	}
+	lines := rpcFunction{
+		schema: "api", name: "lines", required: 1, returnsRows: true, executable: true,
+		args: []rpcArg{{name: "ids", typ: "integer[]", variadic: true}},
+	}
+
+	sql, params := total.call(map[string]interface{}{"order_id": 5.0})
+	if sql != `SELECT "public"."order_total"("order_id" => CAST(:arg_0 AS integer)) AS "order_total"` ||
+		params["arg_0"] != 5.0 {
+		t.Error("Unexpected scalar call", sql, params)
+	}
+	sql, _ = lines.call(map[string]interface{}{"ids": []interface{}{1.0, 2.0}})
+	if sql != `SELECT * FROM "api"."lines"(VARIADIC "ids" => CAST(:arg_0 AS integer[]))` {
+		t.Error("Unexpected set returning call", sql)
+	}
+
+	for _, args := range []map[string]interface{}{
+		{},
+		{"tax": 1.0},
+		{"order_id": 1.0, "discount": 1.0},
+	} {
+		if err := total.accepts(args); err == nil {
+			t.Error(args, "should not be accepted")
+		}
+	}
+	if err := total.accepts(map[string]interface{}{"order_id": 1.0, "tax": 1.0}); err != nil {
+		t.Error(err)
+	}
+
+	denied := total
+	denied.executable = false
+	tests := []struct {
+		functions []rpcFunction
+		args      map[string]interface{}
+		status    int
+	}{
+		{[]rpcFunction{}, map[string]interface{}{}, http.StatusNotFound},
+		{[]rpcFunction{denied}, map[string]interface{}{"order_id": 1.0}, http.StatusForbidden},
+		{[]rpcFunction{total}, map[string]interface{}{"id": 1.0}, http.StatusBadRequest},
+		{[]rpcFunction{denied, total}, map[string]interface{}{"order_id": 1.0}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		_, err := pickFunction(tt.functions, "public", "order_total", tt.args)
+		if status := http.StatusOK; err != nil {
+			status = err.(*echo.HTTPError).Code
+			if status != tt.status {
+				t.Error("pickFunction() =", err, "want", tt.status)
+			}
+		} else if status != tt.status {
+			t.Error("pickFunction() should fail with", tt.status)
+		}
+	}
+}
+
+func Test_rpcKinds(t *testing.T) {
+	// pg_proc has prokind from PostgreSQL 11, proisagg before
+	if kinds := rpcKinds(100012); !strings.Contains(fmt.Sprintf(rpcQuery, kinds), "NOT p.proisagg") {
+		t.Error("PostgreSQL 10 has no prokind", kinds)
+	}
+	if kinds := rpcKinds(110005); kinds != "p.prokind = 'f'" {
+		t.Error("PostgreSQL 11 has no proisagg", kinds)
+	}
+}
+
+func Test_grestRPC(t *testing.T) {
+	for _, raw := range []string{`"api.order_total"`, `{"function": "order_total", "schema": "api"}`} {
+		settings := &grestRPC{}
+		if err := json.Unmarshal([]byte(raw), settings); err != nil {
+			t.Fatal(err)
+		}
+		settings.compile(raw, "postgres")
+		if schema, name, err := settings.target(map[string]interface{}{}); schema != "api" || name != "order_total" || err != nil {
+			t.Error("Unexpected target", schema, name, err, "for", raw)
+		}
+	}
+
+	builtin := &grestRPC{param: "function"}
+	if err := json.Unmarshal([]byte(`true`), builtin); err != nil {
+		t.Fatal(err)
+	}
+	builtin.compile(rpcPath, "postgres")
+	params := map[string]interface{}{"function": "lines", "owner": "", "tenant": "acme"}
+	if schema, name, err := builtin.target(params); schema != "public" || name != "lines" || err != nil {
+		t.Error("Unexpected target", schema, name, err)
+	}
+	for _, function := range []string{"pg_catalog.pg_sleep", "other.lines", ".lines"} {
+		_, _, err := builtin.target(map[string]interface{}{"function": function})
+		if he, ok := err.(*echo.HTTPError); !ok || he.Code != http.StatusNotFound {
+			t.Error("Should 404 on", function, "outside the schema not", err)
+		}
+	}
+	args, err := builtin.args(map[string]interface{}{"ids": []interface{}{1.0}, "tenant": "other"}, params)
+	if err != nil || len(args) != 2 || args["tenant"] != "acme" {
+		t.Error("Unexpected args", args, err)
+	}
+	if _, err := builtin.args([]interface{}{}, params); err == nil {
+		t.Error("Array bodies should not be arguments")
+	}
+}
+
+func TestGenerateSpec(t *testing.T) {
+	api := newSqliteAPI(t, "generate",
+		"CREATE TABLE customers (id INTEGER PRIMARY KEY, name TEXT NOT NULL)",
+		`CREATE TABLE orders (
+			id INTEGER PRIMARY KEY,
+			customer INTEGER REFERENCES customers (id),
+			total REAL NOT NULL DEFAULT 0,
+			placed TIMESTAMP
+		)`,
+		"CREATE VIEW totals AS SELECT customer, SUM(total) AS total FROM orders GROUP BY customer",
+	)
+	swagger, err := api.GenerateSpec("main", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := swagger.Paths["/customers"].Get.Parameters.GetByInAndName("query", "limit").Schema.Value; *limit.Max != 2 ||
+		limit.Default != 2 {
+		t.Error("The page size should be capped by the max limit", limit)
+	}
+
+	orders := swagger.Components.Schemas["orders"].Value
+	if orders.Properties["id"].Value.Type != "integer" || orders.Properties["placed"].Value.Format != "date-time" ||
+		len(orders.Required) != 0 {
+		t.Error("Unexpected orders schema", orders.Properties, orders.Required)
+	}
+	if ref := string(orders.Properties["customer"].Value.Extensions["x-grest-references"].(json.RawMessage)); ref != `{"table":"main.customers","column":"id"}` {
+		t.Error("Unexpected reference", ref)
+	}
+	if required := swagger.Components.Schemas["customers"].Value.Required; len(required) != 1 || required[0] != "name" {
+		t.Error("Unexpected required columns", required)
+	}
+	if totals := swagger.Paths["/totals"]; totals == nil || totals.Post != nil || swagger.Paths["/totals/{id}"] != nil {
+		t.Error("Views should only be listed", totals)
+	}
+
+	spec, err := json.Marshal(swagger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir() + "/generated.json"
+	if err := ioutil.WriteFile(path, spec, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := api.GetServer(path)
+
+	expect := func(body string) TestResponse {
+		return func(t *testing.T, rec *httptest.ResponseRecorder) {
+			if strings.Replace(rec.Body.String(), "\n", "", -1) != body {
+				t.Error("Unexpected body", rec.Body.String(), "want", body)
+			}
+		}
+	}
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			httptest.NewRequest(http.MethodPost, "/customers",
+				strings.NewReader(`[{"id": 1, "name": "ada"}, {"id": 2, "name": "bob"}, {"id": 3, "name": "cy"}]`)),
+			http.StatusOK, NoTest,
+		},
+		{httptest.NewRequest(http.MethodGet, "/customers", nil), http.StatusOK, expect(
+			`[{"id":1,"name":"ada"},{"id":2,"name":"bob"}]`,
+		)},
+		{httptest.NewRequest(http.MethodGet, "/customers?limit=5", nil), http.StatusOK, expect(
+			`[{"id":1,"name":"ada"},{"id":2,"name":"bob"}]`,
+		)},
+		{httptest.NewRequest(http.MethodGet, "/customers?offset=2", nil), http.StatusOK, expect(
+			`[{"id":3,"name":"cy"}]`,
+		)},
+		{httptest.NewRequest(http.MethodGet, "/customers?limit=1&offset=1", nil), http.StatusOK, expect(
+			`[{"id":2,"name":"bob"}]`,
+		)},
+		{
+			httptest.NewRequest(http.MethodPatch, "/customers/2", strings.NewReader(`{"name": "bo'b"}`)),
+			http.StatusOK, NoTest,
+		},
+		{httptest.NewRequest(http.MethodGet, "/customers/2", nil), http.StatusOK, expect(`[{"id":2,"name":"bo'b"}]`)},
+		{httptest.NewRequest(http.MethodDelete, "/customers/3", nil), http.StatusOK, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/customers/3", nil), http.StatusOK, expect(`[]`)},
+		{
+			httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"id": 1, "customer": 1, "total": 5}`)),
+			http.StatusOK, NoTest,
+		},
+		{httptest.NewRequest(http.MethodGet, "/totals", nil), http.StatusOK, expect(`[{"customer":1,"total":5}]`)},
+		{httptest.NewRequest(http.MethodGet, "/orders?select=total,id", nil), http.StatusOK, expect(`[{"id":1,"total":5}]`)},
+		{httptest.NewRequest(http.MethodGet, "/orders?select=*,customer(name)", nil), http.StatusNotImplemented, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/orders?select=(", nil), http.StatusBadRequest, NoTest},
+	})
+}
+
+func TestAutoTables(t *testing.T) {
+	api := newSqliteAPI(t, "auto",
+		"CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT)",
+		"CREATE TABLE note_tags (note INTEGER, tag TEXT)",
+		"CREATE TABLE secrets (id INTEGER PRIMARY KEY, value TEXT)",
+		"CREATE TABLE note_slots (at TEXT PRIMARY KEY, label TEXT)",
+	)
+	spec := `{
+		"openapi": "3.0.2",
+		"info": {"title": "auto", "version": "1.0"},
+		"x-grest-auto": {"schema": "main", "path": "/api", "include": ["note*"], "exclude": ["*_tags"]},
+		"paths": {
+			"/api/notes/{id}": {
+				"get": {
+					"responses": {"200": {"description": "OK"}},
+					"parameters": [{"in": "path", "name": "id", "required": true, "schema": {"type": "string"}}],
+					"x-grest": {"queries": [{"sql": "SELECT body FROM notes WHERE id = :id"}]}
+				}
+			}
+		}
+	}`
+	path := t.TempDir() + "/auto.json"
+	if err := ioutil.WriteFile(path, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := api.GetServer(path)
+
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			httptest.NewRequest(http.MethodPost, "/api/notes", strings.NewReader(`{"id": 1, "body": "it's auto"}`)),
+			http.StatusOK, NoTest,
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/api/notes", nil), http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if !strings.Contains(rec.Body.String(), `"body":"it's auto"`) {
+					t.Error("Unexpected notes", rec.Body.String())
+				}
+			},
+		},
+		// The spec operation is kept, so PATCH and DELETE aren't generated
+		{
+			httptest.NewRequest(http.MethodGet, "/api/notes/1", nil), http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if strings.Contains(rec.Body.String(), `"id"`) {
+					t.Error("Spec operation should be kept", rec.Body.String())
+				}
+			},
+		},
+		{httptest.NewRequest(http.MethodDelete, "/api/notes/1", nil), http.StatusMethodNotAllowed, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/api/note_tags", nil), http.StatusNotFound, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/api/secrets", nil), http.StatusNotFound, NoTest},
+		// Keys are bound, so colons in them are left alone
+		{
+			httptest.NewRequest(http.MethodPost, "/api/note_slots", strings.NewReader(`{"at": "12:30", "label": "lunch"}`)),
+			http.StatusOK, NoTest,
+		},
+		{
+			httptest.NewRequest(http.MethodPatch, "/api/note_slots/12:30", strings.NewReader(`{"label": "late lunch"}`)),
+			http.StatusOK, NoTest,
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/api/note_slots/12:30", nil), http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if !strings.Contains(rec.Body.String(), `"label":"late lunch"`) {
+					t.Error("Unexpected slot", rec.Body.String())
+				}
+			},
+		},
+		{httptest.NewRequest(http.MethodDelete, "/api/note_slots/12:30", nil), http.StatusOK, NoTest},
+		{
+			httptest.NewRequest(http.MethodGet, "/api/note_slots", nil), http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if strings.Contains(rec.Body.String(), "12:30") {
+					t.Error("Slot should be deleted", rec.Body.String())
+				}
+			},
+		},
+	})
+}
+
+func Test_parseSelect(t *testing.T) {
+	items, err := parseSelect("*, lines(*,product(name)),customer(name)")
+	if err != nil || len(items) != 3 || items[1].name != "lines" || items[1].embed[1].embed[0].name != "name" ||
+		items[2].embed[0].name != "name" || items[0].embed != nil {
+		t.Error("Unexpected select", items, err)
+	}
+	for _, bad := range []string{"", "a,,b", "lines(*", "lines(*))", "*(a)", "a()"} {
+		if _, err := parseSelect(bad); err == nil {
+			t.Error(bad, "should not parse")
+		}
+	}
+}
+
+func Test_embedder(t *testing.T) {
+	keys := map[string][]foreignKey{
+		"orders": {
+			{"orders_customer_fkey", "public", "orders", "public", "customers", []string{"customer"}, []string{"id"}},
+			{"lines_order_fkey", "public", "lines", "public", "orders", []string{"order_id"}, []string{"id"}},
+		},
+	}
+	e := &embedder{
+		quoting: dialectOf("postgres"),
+		load: func(schema string, table string) ([]foreignKey, error) {
+			return keys[table], nil
+		},
+	}
+	items, _ := parseSelect("id,lines(*),customer(name)")
+	list, err := e.selectList(items, "public", "orders", `"orders"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []safeSQL{
+		`"orders"."id"`,
+		`(SELECT COALESCE(json_agg("j1"), '[]') FROM (SELECT "e1".* FROM "public"."lines" AS "e1" ` +
+			`WHERE "e1"."order_id" = "orders"."id") AS "j1") AS "lines"`,
+		`(SELECT row_to_json("j2") FROM (SELECT "e2"."name" FROM "public"."customers" AS "e2" ` +
+			`WHERE "e2"."id" = "orders"."customer") AS "j2") AS "customer"`,
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("selectList() = %v want %v", list, want)
+	}
+
+	for _, bad := range []string{"products(*)", "orders(*)"} {
+		items, _ := parseSelect(bad)
+		if _, err := e.selectList(items, "public", "orders", `"orders"`); err == nil {
+			t.Error(bad, "should not be related")
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	output := &embedEncoder{&jsonEncoder{w: c.Response()}, []string{"lines"}}
+	output.Encode(map[string]interface{}{"id": 1, "lines": []byte(`[{"qty":2}]`)})
+	output.End()
+	if body := strings.Replace(rec.Body.String(), "\n", "", -1); body != `[{"id":1,"lines":[{"qty":2}]}]` {
+		t.Error("Embedded JSON should be nested", body)
+	}
+}
+
+func Test_parseFilters(t *testing.T) {
+	query := url.Values{
+		"id":     {"in.(1,2)"},
+		"name":   {"not.like.a*"},
+		"note":   {"is.null"},
+		"limit":  {"10"},
+		"format": {"csv"},
+	}
+	where, params, err := parseFilters(query, map[string]bool{"limit": true}, "sqlite3")
+	want := []safeSQL{`"id" IN (:_filter.0, :_filter.1)`, `NOT ("name" LIKE :_filter.2)`, `"note" IS NULL`}
+	if err != nil || !reflect.DeepEqual(where, want) {
+		t.Errorf("parseFilters() = %v, %v want %v", where, err, want)
+	}
+	if params["_filter.1"] != "2" || params["_filter.2"] != "a%" {
+		t.Error("Unexpected filter params", params)
+	}
+
+	for _, bad := range []string{"5", "is.maybe", "in.1,2", "between.1"} {
+		if _, _, err := parseFilters(url.Values{"id": {bad}}, map[string]bool{}, "postgres"); err == nil {
+			t.Error(bad, "should not be a filter")
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	server := newSqliteAPI(t, "filters",
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, note TEXT)",
+		"INSERT INTO items VALUES (1, 'apple', NULL), (2, 'banana', 'ripe'), (3, 'avocado', NULL)",
+	).GetServer("./sqlite3.openapi.yml")
+
+	ids := func(want ...float64) func(t *testing.T, rec *httptest.ResponseRecorder) {
+		return func(t *testing.T, rec *httptest.ResponseRecorder) {
+			target := []map[string]interface{}{}
+			json.NewDecoder(rec.Body).Decode(&target)
+			got := []float64{}
+			for _, row := range target {
+				got = append(got, row["id"].(float64))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Should have returned ids %v not %v", want, got)
+			}
+		}
+	}
+
+	runHTTPTests(t, server, []HTTPTest{
+		{httptest.NewRequest(http.MethodGet, "/_data/items?id=eq.2", nil), http.StatusOK, ids(2)},
+		{httptest.NewRequest(http.MethodGet, "/_data/items?id=in.(1,3)", nil), http.StatusOK, ids(1, 3)},
+		{httptest.NewRequest(http.MethodGet, "/_data/items?name=like.a*&note=is.null", nil), http.StatusOK, ids(1, 3)},
+		{httptest.NewRequest(http.MethodGet, "/_data/items?note=not.is.null", nil), http.StatusOK, ids(2)},
+		{httptest.NewRequest(http.MethodGet, "/_data/items?id=between.1", nil), http.StatusBadRequest, NoTest},
+		// Updating or deleting every row needs a filter
+		{
+			httptest.NewRequest(http.MethodPatch, "/_data/items", strings.NewReader(`{"note": "all"}`)),
+			http.StatusBadRequest, NoTest,
+		},
+		{httptest.NewRequest(http.MethodDelete, "/_data/items", nil), http.StatusBadRequest, NoTest},
+		{
+			httptest.NewRequest(http.MethodPatch, "/_data/items?name=like.a*", strings.NewReader(`{"note": "fruit"}`)),
+			http.StatusOK, NoTest,
+		},
+		{httptest.NewRequest(http.MethodGet, "/_data/items?note=eq.fruit", nil), http.StatusOK, ids(1, 3)},
+		{httptest.NewRequest(http.MethodDelete, "/_data/items?id=gt.2", nil), http.StatusOK, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/_data/items", nil), http.StatusOK, ids(1, 2)},
+		// Dropping the table is apart from its rows
+		{httptest.NewRequest(http.MethodDelete, "/_ddl/items", nil), http.StatusOK, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/_data/items", nil), http.StatusNotFound, NoTest},
+	})
+}
+
+func TestMigrations(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"1_customers.up.sql":   "CREATE TABLE customers (id INTEGER PRIMARY KEY, name TEXT);\nINSERT INTO customers VALUES (1, 'a');",
+		"1_customers.down.sql": "DROP TABLE customers;",
+		"2_notes.up.sql":       "ALTER TABLE customers ADD COLUMN note TEXT;",
+		"2_notes.down.sql":     "",
+		"README.md":            "not a migration",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := newSqliteAPI(t, "migrations")
+
+	// Reading the status before migrating leaves the database as it is
+	if status, err := api.MigrationStatus(dir); err != nil || len(status) != 2 || status[0].State != "pending" {
+		t.Error("Should list both migrations as pending not", status, err)
+	}
+	if _, err := api.sql.NamedExec("SELECT * FROM grest_migrations", map[string]interface{}{}); err == nil {
+		t.Error("Reading the status should not create the tracking table")
+	}
+
+	applied, err := api.Migrate(dir)
+	if err != nil || len(applied) != 2 || applied[0].Name != "customers" || applied[1].Version != 2 {
+		t.Fatal("Should have applied both migrations not", applied, err)
+	}
+	if applied, err := api.Migrate(dir); err != nil || len(applied) != 0 {
+		t.Error("Should have nothing left to apply not", applied, err)
+	}
+	if _, err := api.sql.NamedExec("UPDATE customers SET note = 'x'", map[string]interface{}{}); err != nil {
+		t.Error("Migrations should have added the note column", err)
+	}
+
+	reverted, err := api.MigrateDown(dir, 1)
+	if err != nil || len(reverted) != 1 || reverted[0].Version != 2 {
+		t.Error("Should have reverted the last migration not", reverted, err)
+	}
+	created, err := CreateMigration(dir, "orders")
+	if err != nil || len(created) != 2 || !strings.HasSuffix(created[0], "_orders.up.sql") {
+		t.Fatal("Should have created the migration files not", created, err)
+	}
+	if _, err := CreateMigration(dir, "bad name"); err == nil {
+		t.Error("Migration names should be plain")
+	}
+
+	status, err := api.MigrationStatus(dir)
+	states := []string{}
+	for _, s := range status {
+		states = append(states, s.State)
+	}
+	if err != nil || !reflect.DeepEqual(states, []string{"applied", "pending", "pending"}) || status[0].AppliedAt == "" {
+		t.Error("Unexpected migration status", status, err)
+	}
+
+	// Editing an applied migration stops further runs
+	ioutil.WriteFile(filepath.Join(dir, "1_customers.up.sql"), []byte("CREATE TABLE customers (id INTEGER)"), 0644)
+	if _, err := api.Migrate(dir); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Error("Should refuse edited migrations not", err)
+	}
+	if status, _ := api.MigrationStatus(dir); len(status) == 0 || status[0].State != "changed" {
+		t.Error("Should report the edited migration not", status)
+	}
+}
+
+func TestReload(t *testing.T) {
+	spec := func(path string, sql string) string {
+		return `{
+			"openapi": "3.0.2",
+			"info": {"title": "reload", "version": "1.0"},
+			"paths": {"` + path + `": {"get": {
+				"responses": {"200": {"description": "OK"}},
+				"x-grest": {"queries": [{"sql": "` + sql + `"}]}
+			}}}
+		}`
+	}
+	file := filepath.Join(t.TempDir(), "spec.json")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(spec("/old", "SELECT 1 AS one"))
+
+	if _, err := newSqliteAPI(t, "reload").NewReloader("/_admin/reload", nil, file); err == nil {
+		t.Error("The reload path should need admins")
+	}
+	reloader, err := newSqliteAPI(t, "reload").NewReloader("/_admin/reload", []string{"anon"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runHTTPTests(t, reloader, []HTTPTest{
+		{httptest.NewRequest(http.MethodGet, "/old", nil), http.StatusOK, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/new", nil), http.StatusNotFound, NoTest},
+	})
+
+	// Invalid specs keep the old routes
+	write(spec("/new", "SELECT {{.broken"))
+	runHTTPTests(t, reloader, []HTTPTest{
+		{httptest.NewRequest(http.MethodPost, "/_admin/reload", nil), http.StatusUnprocessableEntity, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/old", nil), http.StatusOK, NoTest},
+	})
+	if _, err := newSqliteAPI(t, "reload").LoadServer(file); err == nil {
+		t.Error("LoadServer should fail for invalid templates")
+	}
+
+	write(spec("/new", "SELECT 2 AS two"))
+	runHTTPTests(t, reloader, []HTTPTest{
+		{httptest.NewRequest(http.MethodPost, "/_admin/reload", nil), http.StatusOK, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/old", nil), http.StatusNotFound, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/new", nil), http.StatusOK, NoTest},
+	})
+
+	// Routes of the old spec keep its security, and only admins reload
+	secured := func(password string) string {
+		return `{
+			"openapi": "3.0.2",
+			"info": {"title": "reload", "version": "1.0"},
+			"security": [{"basic": []}],
+			"components": {"securitySchemes": {"basic": {
+				"type": "http", "scheme": "basic",
+				"x-grest-password-query": {"check": "SELECT 'admin' AS username WHERE :password = '` + password + `'"}
+			}}},
+			"paths": {"/secret": {"get": {
+				"responses": {"200": {"description": "OK"}},
+				"x-grest": {"queries": [{"sql": "SELECT 1 AS one"}]}
+			}}}
+		}`
+	}
+	login := func(method string, path string, password string) *http.Request {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("admin", password)
+		return req
+	}
+	securedFile := filepath.Join(t.TempDir(), "secured.json")
+	ioutil.WriteFile(securedFile, []byte(secured("old")), 0644)
+	securedReloader, err := newSqliteAPI(t, "secured").NewReloader("/_admin/reload", []string{"root"}, securedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := securedReloader.router.Load().(*echo.Echo)
+	ioutil.WriteFile(securedFile, []byte(secured("new")), 0644)
+	if err := securedReloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	runHTTPTests(t, old, []HTTPTest{
+		{login(http.MethodGet, "/secret", "old"), http.StatusOK, NoTest},
+	})
+	runHTTPTests(t, securedReloader, []HTTPTest{
+		{login(http.MethodGet, "/secret", "old"), http.StatusUnauthorized, NoTest},
+		{login(http.MethodGet, "/secret", "new"), http.StatusOK, NoTest},
+		{login(http.MethodPost, "/_admin/reload", "new"), http.StatusForbidden, NoTest},
+	})
+
+	// Watching picks up edits of the file
+	stop := make(chan struct{})
+	defer close(stop)
+	go reloader.Watch(10*time.Millisecond, stop)
+	write(spec("/watched", "SELECT 3 AS three"))
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Minute))
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		reloader.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/watched", nil))
+		if rec.Code == http.StatusOK {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Watch should have reloaded the edited spec")
+}
+
+func TestLoadSpec(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	shared := write("shared.yml", `
+openapi: '3.0.2'
+info: {title: shared, version: '1.0'}
+paths: {}
+x-grest-strict-templates: true
+components:
+  x-grest-templates:
+    table: '{{ident .table}}'
+  parameters:
+    table:
+      in: path
+      name: table
+      required: true
+      x-grest-template-allowed: true
+      schema: {type: string}
+`)
+	items := write("items.yml", `
+openapi: '3.0.2'
+info: {title: items, version: '1.0'}
+paths:
+  /items/{table}:
+    get:
+      responses: {'200': {description: OK}}
+      parameters:
+        - $ref: 'shared.yml#/components/parameters/table'
+      x-grest:
+        queries:
+          - sql: 'SELECT * FROM {{template "table" .}}'
+`)
+	notes := write("notes.yml", `
+openapi: '3.0.2'
+info: {title: notes, version: '1.0'}
+paths:
+  /notes:
+    parameters:
+      - {in: query, name: limit, schema: {type: integer}}
+    get:
+      responses: {'200': {description: OK}}
+      x-grest:
+        queries:
+          - sql: 'SELECT 1 AS id'
+x-grest-strict-templates: true
+`)
+	write("README.md", "not a spec")
+
+	swagger, err := LoadSpec(dir)
+	if err != nil || swagger.Info.Title != "items" || len(swagger.Paths) != 2 {
+		t.Fatal("Should have merged the directory", err)
+	}
+
+	server := newSqliteAPI(t, "merged",
+		"CREATE TABLE things (id INTEGER PRIMARY KEY)",
+		"INSERT INTO things VALUES (1)",
+	).GetServer(dir)
+	runHTTPTests(t, server, []HTTPTest{
+		{httptest.NewRequest(http.MethodGet, "/items/things", nil), http.StatusOK, NoTest},
+		{httptest.NewRequest(http.MethodGet, "/notes", nil), http.StatusOK, NoTest},
+	})
+	if _, err := LoadSpec(items, notes); err != nil {
+		t.Error("External $refs should load without listing their file", err)
+	}
+
+	for name, conflict := range map[string]string{
+		"operation": `
+openapi: '3.0.2'
+info: {title: again, version: '1.0'}
+paths:
+  /notes:
+    get:
+      responses: {'200': {description: OK}}
+`,
+		"path parameter": `
+openapi: '3.0.2'
+info: {title: again, version: '1.0'}
+paths:
+  /notes:
+    parameters:
+      - {in: query, name: limit, schema: {type: string}}
+    post:
+      responses: {'200': {description: OK}}
+`,
+		"parameter": `
+openapi: '3.0.2'
+info: {title: again, version: '1.0'}
+paths: {}
+components:
+  parameters:
+    table: {in: query, name: table, schema: {type: string}}
+`,
+		"template": `
+openapi: '3.0.2'
+info: {title: again, version: '1.0'}
+paths: {}
+components:
+  x-grest-templates:
+    table: '{{literal .table}}'
+`,
+		"extension": `
+openapi: '3.0.2'
+info: {title: again, version: '1.0'}
+paths: {}
+x-grest-strict-templates: false
+`,
+	} {
+		other := write("conflict.yml", conflict)
+		if _, err := LoadSpec(shared, notes, other); err == nil || !strings.Contains(err.Error(), "both define") {
+			t.Error("Conflicting", name, "should fail not", err)
+		}
+	}
+	if _, err := LoadSpec(shared, shared); err != nil {
+		t.Error("Identical definitions should merge", err)
+	}
+
+	more := write("more.yml", `
+openapi: '3.0.2'
+info: {title: more, version: '1.0'}
+paths:
+  /notes:
+    parameters:
+      - {in: query, name: limit, schema: {type: integer}}
+      - {in: query, name: offset, schema: {type: integer}}
+    post:
+      responses: {'200': {description: OK}}
+`)
+	swagger, err = LoadSpec(notes, more)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params := swagger.Paths["/notes"].Parameters; len(params) != 2 ||
+		params.GetByInAndName("query", "offset") == nil {
+		t.Error("Should have merged the path parameters without duplicates not", params)
+	}
+}
+
+func TestDocs(t *testing.T) {
+	server := newSqliteAPI(t, "docs").GetServer("./sqlite3.openapi.yml")
+
+	runHTTPTests(t, server, []HTTPTest{
+		{
+			httptest.NewRequest(http.MethodGet, "/openapi.json", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if strings.Contains(rec.Body.String(), "x-grest") {
+					t.Error("Should have stripped the x-grest extensions")
+				}
+				document := struct {
+					Servers []map[string]string    `json:"servers"`
+					Paths   map[string]interface{} `json:"paths"`
+				}{}
+				json.NewDecoder(rec.Body).Decode(&document)
+				if len(document.Servers) != 1 || document.Servers[0]["url"] != "https://api.server.test/v1" {
+					t.Error("Should have kept the servers of the spec not", document.Servers)
+				}
+				if document.Paths["/_data/{table}"] == nil {
+					t.Error("Should have documented the paths of the spec")
+				}
+			},
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/docs", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if !strings.Contains(rec.Body.String(), `url: "/openapi.json"`) ||
+					!strings.Contains(rec.Body.String(), `src="/docs/assets/swagger-ui-bundle.js"`) {
+					t.Error("The docs page should load the document with Swagger UI", rec.Body.String())
+				}
+			},
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/docs/assets/swagger-ui-bundle.js", nil),
+			http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if !strings.Contains(rec.Body.String(), "SwaggerUIBundle") {
+					t.Error("Should have served the embedded Swagger UI")
+				}
+			},
+		},
+		{httptest.NewRequest(http.MethodGet, "/docs/assets/swagger-ui.css", nil), http.StatusOK, NoTest},
+	})
+
+	// The configured server replaces the servers, whatever the Host header
+	swagger, err := LoadSpec("./sqlite3.openapi.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	if err := addDocs(e, swagger, grestDocs{Server: "https://api.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	req.Host = "evil.example.com"
+	runHTTPTests(t, e, []HTTPTest{
+		{req, http.StatusOK, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			if strings.Contains(rec.Body.String(), "evil") || !strings.Contains(rec.Body.String(), `"url":"https://api.example.com"`) {
+				t.Error("Should have served the configured server not", rec.Body.String())
+			}
+		}},
+	})
+
+	internals := publicDocument(map[string]interface{}{
+		"x-grest": "SELECT",
+		"parameters": []interface{}{
+			map[string]interface{}{"$ref": "shared.yml#/components/parameters/table"},
+		},
+	}, false)
+	want := map[string]interface{}{
+		"parameters": []interface{}{map[string]interface{}{"$ref": "#/components/parameters/table"}},
+	}
+	if !reflect.DeepEqual(internals, want) {
+		t.Errorf("publicDocument() = %v want %v", internals, want)
+	}
+}
+
+func Test_clientNameCollisions(t *testing.T) {
+	swagger, err := openapi3.NewSwaggerLoader().LoadSwaggerFromData([]byte(`
+openapi: '3.0.2'
+info: {title: collisions, version: '1.0'}
+paths:
+  /things/{id}:
+    parameters:
+      - {in: path, name: id, required: true, schema: {type: string}}
+    get:
+      parameters:
+        - {in: path, name: id, required: true, schema: {type: integer}}
+        - {in: query, name: filter, schema: {type: string}}
+      responses:
+        '200':
+          description: OK
+          content:
+            application/json:
+              schema:
+                type: object
+                properties:
+                  a_b: {type: string}
+                  aB: {type: integer}
+      x-grest:
+        filter: {}
+        queries:
+          - sql: SELECT 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := GenerateClient(swagger, "things")
+	if err != nil {
+		t.Fatal(err, string(source))
+	}
+	for _, want := range []string{
+		"AB *int64 `json:\"aB,omitempty\"`",
+		"AB2 *string `json:\"a_b,omitempty\"`",
+		"Filter2 *string",
+		"Id int64",
+	} {
+		if !strings.Contains(strings.Join(strings.Fields(string(source)), " "), want) {
+			t.Error("Generated client should have", want)
+		}
+	}
+	if strings.Contains(string(source), "Id2") {
+		t.Error("Operation params should replace path params of the same name")
+	}
+}
+
+func TestClient(t *testing.T) {
+	swagger, err := LoadSpec("./client.openapi.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := GenerateClient(swagger, "notes")
+	if err != nil {
+		t.Fatal(err, string(source))
+	}
+	for _, want := range []string{
+		"type Note struct",
+		"Author *string `json:\"author,omitempty\"`",
+		"func (c *Client) ListNotes(ctx context.Context, params ListNotesParams) ([]Note, error)",
+		"func (c *Client) CreateNote(ctx context.Context, params CreateNoteParams, body Note) ([]map[string]interface{}, error)",
+		"func (c *Client) GetNotesById(ctx context.Context, params GetNotesByIdParams) ([]byte, error)",
+		"Filter url.Values",
+	} {
+		// Ignoring the alignment of gofmt
+		if !strings.Contains(strings.Join(strings.Fields(string(source)), " "), want) {
+			t.Error("Generated client should have", want)
+		}
+	}
+
+	for _, spec := range []string{"../openapi.yml", "./sqlite3.openapi.yml", "./orders.openapi.yml"} {
+		other, err := LoadSpec(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GenerateClient(other, "other"); err != nil {
+			t.Error("Should generate a client of", spec, err)
+		}
+	}
+
+	goTool, err := exec.LookPath("go")
+	if err != nil || testing.Short() {
+		t.Skip("Round trip needs the go tool")
+	}
+
+	// Round trip, a program using the client against the server
+	server := httptest.NewServer(newSqliteAPI(t, "client",
+		"CREATE TABLE notes (id INTEGER PRIMARY KEY, text TEXT, author TEXT)",
+		"CREATE TABLE users (username TEXT, password TEXT)",
+		"INSERT INTO users VALUES ('ann', 'secret')",
+	).GetServer("./client.openapi.yml"))
+	defer server.Close()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":          "module roundtrip\n\ngo 1.15\n",
+		"notes/client.go": string(source),
+		"main.go": `package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+
+	"roundtrip/notes"
+)
+
+func main() {
+	ctx := context.Background()
+	client := notes.NewClient(os.Args[1])
+	if _, err := client.ListNotes(ctx, notes.ListNotesParams{}); err == nil {
+		panic("should need credentials")
+	} else if failure, ok := err.(*notes.Error); !ok || failure.StatusCode != 401 {
+		panic(err)
+	}
+
+	client.Username, client.Password = "ann", "secret"
+	author := "ann"
+	for id, text := range []string{"first", "second", "third"} {
+		note := notes.Note{Id: int64(id + 1), Text: text, Author: &author}
+		if _, err := client.CreateNote(ctx, notes.CreateNoteParams{}, note); err != nil {
+			panic(err)
+		}
+	}
+	limit := int64(2)
+	listed, err := client.ListNotes(ctx, notes.ListNotesParams{Limit: &limit})
+	if err != nil {
+		panic(err)
+	}
+	filtered, err := client.ListNotes(ctx, notes.ListNotesParams{Filter: url.Values{"text": {"eq.first"}}})
+	if err != nil {
+		panic(err)
+	}
+	csv, err := client.GetNotesById(ctx, notes.GetNotesByIdParams{Id: 2})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(len(listed), listed[0].Id, listed[0].Text, *listed[0].Author)
+	fmt.Println(len(filtered), filtered[0].Text)
+	fmt.Print(string(csv))
+}
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := exec.Command(goTool, "run", ".", server.URL)
+	run.Dir = dir
+	output, err := run.CombinedOutput()
+	want := "2 3 third ann\n1 first\nid,text\n2,second\n"
+	if err != nil || string(output) != want {
+		t.Errorf("Round trip printed %q, %v want %q", output, err, want)
+	}
+}
+
+func TestSqliteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grest.db")
+	api := newSqliteAPI(t, path,
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)",
+		"CREATE TABLE tags (item_id INTEGER REFERENCES items (id), tag TEXT)",
+	)
+	server := api.GetServer("./sqlite3.openapi.yml")
+
+	// Concurrent writes queue for the writer instead of failing as locked
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			insert := httptest.NewRequest(
+				http.MethodPost, "/_data/items",
+				strings.NewReader(fmt.Sprintf(`[{"id": %d, "name": "item %d"}]`, i, i)),
+			)
+			insert.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, insert)
+			if rec.Code != http.StatusOK {
+				t.Error("Concurrent insert failed", rec.Code, rec.Body.String())
+			}
+			rec = httptest.NewRecorder()
+			server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_data/items", nil))
+			if rec.Code != http.StatusOK {
+				t.Error("Concurrent read failed", rec.Code, rec.Body.String())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	tag := httptest.NewRequest(http.MethodPost, "/_data/tags", strings.NewReader(`[{"item_id": 100, "tag": "x"}]`))
+	tag.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, tag)
+	if rec.Code == http.StatusOK {
+		t.Error("Foreign keys should be enforced")
+	}
+
+	// The rows outlive the API, read by a new one on the same file
+	reopened := NewApi("jdbc:sqlite3://" + path)
+	rows, err := reopened.sql.NamedQuery(
+		"SELECT (SELECT count(*) FROM items) AS items, journal_mode, foreign_keys FROM pragma_journal_mode, pragma_foreign_keys",
+		map[string]interface{}{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	row := map[string]interface{}{}
+	if !rows.Next() || rows.MapScan(row) != nil {
+		t.Fatal("Should have read the pragmas", rows.Err())
+	}
+	if formatValue(row["items"]) != "20" || formatValue(row["journal_mode"]) != "wal" || formatValue(row["foreign_keys"]) != "1" {
+		t.Error("Should have 20 items in a WAL database with foreign keys not", row)
+	}
+}
+
+func TestBufferedWrites(t *testing.T) {
+	api := newSqliteAPI(t, "buffered",
+		"CREATE TABLE items (id INTEGER PRIMARY KEY)",
+		"CREATE TABLE log (item INTEGER)",
+		"INSERT INTO items VALUES (1)",
+	)
+	spec := `{
+		"openapi": "3.0.2",
+		"info": {"title": "buffered", "version": "1.0"},
+		"paths": {
+			"/log": {
+				"get": {
+					"responses": {"200": {"description": "OK"}},
+					"x-grest": {"queries": [{"sql": "SELECT item FROM log ORDER BY item"}]}
+				}
+			},
+			"/items/{id}": {
+				"post": {
+					"responses": {"200": {"description": "OK"}},
+					"parameters": [{"in": "path", "name": "id", "required": true, "schema": {"type": "integer"}}],
+					"x-grest": {"queries": [
+						{"sql": "INSERT INTO log VALUES (:id)"},
+						{"sql": "INSERT INTO items VALUES (:id)"},
+						{"sql": "SELECT id FROM items ORDER BY id"}
+					]}
+				}
+			}
+		}
+	}`
+	path := t.TempDir() + "/buffered.json"
+	if err := ioutil.WriteFile(path, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := api.GetServer(path)
+
+	runHTTPTests(t, server, []HTTPTest{
+		// The duplicate key fails after the log row was written
+		{
+			httptest.NewRequest(http.MethodPost, "/items/1", nil), http.StatusConflict,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if !strings.Contains(rec.Body.String(), "UNIQUE constraint failed: items.id") || strings.Contains(rec.Body.String(), `"id"`) {
+					t.Error("Should only send the constraint failure", rec.Body.String())
+				}
+			},
+		},
+		{
+			httptest.NewRequest(http.MethodGet, "/log", nil), http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if rec.Body.String() != "[]\n" {
+					t.Error("The log row should be rolled back", rec.Body.String())
+				}
+			},
+		},
+		{
+			httptest.NewRequest(http.MethodPost, "/items/2", nil), http.StatusOK,
+			func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if rec.Body.String() != "[{\"id\":1}\n,{\"id\":2}\n]\n" {
+					t.Error("Committed rows should be sent", rec.Body.String())
+				}
+			},
+		},
+	})
+
+	// Rows encoded before a failure are dropped for the error
+	for _, failure := range []error{nil, errors.New("commit failed")} {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/items", nil), rec)
+		buffered := bufferResponse(c.Response())
+		if err := c.JSON(http.StatusCreated, []int{1}); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Body.Len() != 0 {
+			t.Error("Nothing should be sent before finish", rec.Body.String())
+		}
+		err := buffered.finish(failure)
+		if failure != nil && (err != failure || rec.Body.Len() != 0 || c.Response().Committed) {
+			t.Error("Should have dropped the rows for the error", err, rec.Body.String())
+		}
+		if failure == nil && (err != nil || rec.Code != http.StatusCreated || rec.Body.String() != "[1]\n") {
+			t.Error("Should have sent the rows", err, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// largeObjectTx - serves large objects from memory, as SQLite has none
+type largeObjectTx struct {
+	txInterface
+	objects map[uint32][]byte
+	reads   *int
+}
+
+func (txn largeObjectTx) OpenLargeObject(oid uint32) (io.ReadSeeker, error) {
+	return &countingReadSeeker{bytes.NewReader(txn.objects[oid]), txn.reads}, nil
+}
+
+type countingReadSeeker struct {
+	io.ReadSeeker
+	reads *int
+}
+
+func (r *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	*r.reads += n
+	return n, err
+}
+
+func Test_rawLargeObjectETag(t *testing.T) {
+	e := echo.New()
+	reads := 0
+	txn := largeObjectTx{objects: map[uint32][]byte{1: []byte("first")}, reads: &reads}
+	serve := func(settings *grestRaw, sha string, header string, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		raw := newRawResponse(e.NewContext(req, rec), settings)
+		raw.Encode(map[string]interface{}{"oid": int64(1), "sha256": sha})
+		if err := raw.EndTxn(txn); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+	withETag := &grestRaw{Column: "oid", LargeObject: true, ETag: "sha256"}
+
+	rec := serve(withETag, "abc", "", "")
+	if etag := rec.Header().Get("ETag"); etag != `"abc"` || reads != len("first") {
+		t.Error("Should use the stored hash, reading the object once, not", etag, reads)
+	}
+	if rec := serve(withETag, "abc", "If-None-Match", `"abc"`); rec.Code != http.StatusNotModified {
+		t.Error("Unchanged object should not be modified not", rec.Code)
+	}
+	// Rewritten with a new hash
+	txn.objects[1] = []byte("other")
+	if rec := serve(withETag, "def", "If-None-Match", `"abc"`); rec.Code != http.StatusOK || rec.Body.String() != "other" {
+		t.Error("Rewritten object should be sent not", rec.Code, rec.Body.String())
+	}
+	rec = serve(&grestRaw{Column: "oid", LargeObject: true}, "", "Range", "bytes=0-1")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "ot" || rec.Header().Get("ETag") != "" {
+		t.Error("Unexpected range without a stored hash", rec.Code, rec.Body.String(), rec.Header())
+	}
+}
+
+// largeObjects - a driver with the lo functions over in memory objects,
+// counting the chunks read by lo_get
+var largeObjects = map[int64][]byte{}
+var largeObjectGets = 0
+
+func init() {
+	sql.Register("sqlite3_lo", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("lo_open", func(oid int64, mode int64) int64 { return oid }, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("lo_lseek64", func(fd int64, offset int64, whence int64) int64 {
+				return int64(len(largeObjects[fd]))
+			}, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("lo_close", func(fd int64) int64 { return 0 }, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("lo_get", func(oid int64, offset int64, length int64) []byte {
+				largeObjectGets++
+				object := largeObjects[oid]
+				end := offset + length
+				if end > int64(len(object)) {
+					end = int64(len(object))
+				}
+				return object[offset:end]
+			}, false)
+		},
+	})
+}
+
+func Test_sqlLargeObject(t *testing.T) {
+	db := sqlx.MustOpen("sqlite3_lo", ":memory:")
+	defer db.Close()
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	content := bytes.Repeat([]byte("0123456789"), largeObjectChunk/4)
+	largeObjects[1] = content
+	object, err := openSQLLargeObject(txBackend{tx}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadAll(object)
+	if err != nil || !bytes.Equal(read, content) || largeObjectGets != 3 {
+		t.Error("Should read the object in chunks not", len(read), err, largeObjectGets)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", "bytes=5-9")
+	rec := httptest.NewRecorder()
+	http.ServeContent(rec, req, "", time.Time{}, object)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "56789" {
+		t.Error("Should seek within the object not", rec.Code, rec.Body.String())
+	}
+}
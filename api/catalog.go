@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/labstack/echo/v4"
+)
+
+// How long catalog names are cached for a role unless x-grest-catalog-ttl
+// is set on the spec
+const defaultCatalogTTL = time.Minute
+
+// Queries listing the names visible to the current role, scope is the
+// dot separated schema (and table) the name belongs to
+var catalogQueries = map[string]map[string]string{
+	"postgres": {
+		"database": `SELECT datname AS name, '' AS scope FROM pg_catalog.pg_database
+			WHERE NOT datistemplate AND has_database_privilege(datname, 'CONNECT')`,
+		"schema": `SELECT schema_name AS name, '' AS scope FROM information_schema.schemata`,
+		"table":  `SELECT table_name AS name, table_schema AS scope FROM information_schema.tables`,
+		"column": `SELECT column_name AS name, table_schema || '.' || table_name AS scope
+			FROM information_schema.columns`,
+		"role": `SELECT rolname AS name, '' AS scope FROM pg_catalog.pg_roles`,
+	},
+	"sqlite3": {
+		"database": `SELECT name, '' AS scope FROM pragma_database_list`,
+		"schema":   `SELECT name, '' AS scope FROM pragma_database_list`,
+		"table": `SELECT name, 'main' AS scope FROM sqlite_master
+			WHERE type IN ('table', 'view')`,
+		"column": `SELECT p.name AS name, 'main.' || m.name AS scope
+			FROM sqlite_master AS m, pragma_table_info(m.name) AS p
+			WHERE m.type IN ('table', 'view')`,
+	},
+}
+
+func catalogDialect(driverName string) string {
+	if driverName == "sqlite3" {
+		return "sqlite3"
+	}
+	return "postgres"
+}
+
+// grestIdentifier - x-grest-identifier on a parameter, either the kind or
+// an object naming the params that scope it
+type grestIdentifier struct {
+	// Kind is database, schema, table, column or role
+	Kind string `json:"kind"`
+	// Schema names the param holding the schema of a table or column
+	Schema string `json:"schema"`
+	// Table names the param holding the table of a column
+	Table string `json:"table"`
+}
+
+func (i *grestIdentifier) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &i.Kind); err == nil {
+		return nil
+	}
+	type plain grestIdentifier
+	return json.Unmarshal(data, (*plain)(i))
+}
+
+// identifier - param that must name an object of the catalog
+type identifier struct {
+	param string
+	grestIdentifier
+}
+
+// key - the catalog name of the identifier for the request params, which
+// the operation declares as checkScopes made sure
+func (i identifier) key(params map[string]interface{}) string {
+	parts := []string{}
+	for _, scope := range []string{i.Schema, i.Table} {
+		if scope != "" {
+			parts = append(parts, fmt.Sprint(params[paramKey(scope)]))
+		}
+	}
+	return strings.Join(append(parts, fmt.Sprint(params[i.param])), ".")
+}
+
+// checkScopes - fails unless the params scoping the identifiers are
+// declared on the operation, as the check would silently match a less
+// qualified name without them
+func checkScopes(at string, identifiers []identifier, params []openapi3.Parameter) error {
+	declared := map[string]bool{}
+	for _, param := range params {
+		declared[paramKey(param.Name)] = true
+	}
+	for _, i := range identifiers {
+		for _, scope := range []string{i.Schema, i.Table} {
+			if scope != "" && !declared[paramKey(scope)] {
+				return fmt.Errorf(
+					"x-grest-identifier on %s %s is scoped by param %s, which the operation doesn't declare",
+					at, i.param, scope,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// catalog - per role cache of the names in the database catalog
+type catalog struct {
+	mutex   sync.Mutex
+	entries map[string]catalogEntry
+}
+
+type catalogEntry struct {
+	loaded time.Time
+	names  map[string]bool
+}
+
+func newCatalog() *catalog {
+	return &catalog{entries: map[string]catalogEntry{}}
+}
+
+// names - the names of a kind visible to the role, loaded in txn after the
+// role was set when cached longer than ttl ago
+func (c *catalog) names(
+	txn txInterface, ttl time.Duration, query string, role string, kind string) (map[string]bool, error) {
+
+	c.mutex.Lock()
+	entry, ok := c.entries[role+" "+kind]
+	c.mutex.Unlock()
+	if ok && time.Since(entry.loaded) < ttl {
+		return entry.names, nil
+	}
+
+	rows, err := txn.NamedQuery(query, map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entry = catalogEntry{time.Now(), map[string]bool{}}
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			return nil, err
+		}
+		name := formatValue(row["name"])
+		entry.names[name] = true
+
+		// Qualify by each suffix of the scope, so public.orders.id
+		// is also known as orders.id
+		scope := strings.Split(formatValue(row["scope"]), ".")
+		for i := range scope {
+			if scope[i] != "" {
+				entry.names[strings.Join(append(scope[i:], name), ".")] = true
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.entries[role+" "+kind] = entry
+	c.mutex.Unlock()
+	return entry.names, nil
+}
+
+func (c *catalog) refresh() {
+	c.mutex.Lock()
+	c.entries = map[string]catalogEntry{}
+	c.mutex.Unlock()
+}
+
+// RefreshCatalog - forgets the cached catalog names of every role
+func (api *API) RefreshCatalog() {
+	if api.catalog != nil {
+		api.catalog.refresh()
+	}
+}
+
+// checkIdentifiers - 404 unless every identifier param names an object
+// visible to the role, with names cached for ttl
+func (api *API) checkIdentifiers(txn txInterface, ttl time.Duration,
+	role string, identifiers []identifier, params map[string]interface{}) error {
+
+	queries := catalogQueries[catalogDialect(api.sql.DriverName())]
+	for _, param := range identifiers {
+		names, err := api.catalog.names(txn, ttl, queries[param.Kind], role, param.Kind)
+		if err != nil {
+			log.Println("Failed to load catalog", param.Kind, err)
+			return errorMapping(err)
+		}
+		if key := param.key(params); !names[key] {
+			return echo.NewHTTPError(
+				http.StatusNotFound, fmt.Sprintf("Unknown %s %s", param.Kind, key),
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,537 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// Prefix of $refs naming component schemas, which become named types
+const schemasRef = "#/components/schemas/"
+
+var nameParts = regexp.MustCompile("[A-Za-z0-9]+")
+
+// exportName - a Go exported name from words like _data or on_conflict
+func exportName(words ...string) string {
+	name := ""
+	for _, word := range words {
+		for _, part := range nameParts.FindAllString(word, -1) {
+			name += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "X" + name
+	}
+	return name
+}
+
+// clientType - a struct generated from an object schema
+type clientType struct {
+	Name        string
+	Description string
+	Fields      []clientField
+	// Alias is the type of component schemas that aren't objects
+	Alias string
+}
+
+type clientField struct {
+	Name string
+	JSON string
+	Type string
+}
+
+// clientParam - a field of the params of an operation
+type clientParam struct {
+	Field string
+	Name  string
+	In    string
+	Type  string
+	// Kind is how the value is written, value, pointer or slice
+	Kind string
+}
+
+// clientOperation - a method of the client
+type clientOperation struct {
+	Name    string
+	Summary string
+	Method  string
+	Path    string
+	Params  []clientParam
+	Filter  bool
+	// Body is the Go type of a JSON body, BodyType the media type of other
+	// bodies, which are an io.Reader
+	Body     string
+	BodyType string
+	// Result is the Go type of a JSON response, []byte for others
+	Result string
+	Accept string
+}
+
+// clientGenerator - collects the types and operations of a spec
+type clientGenerator struct {
+	types      []*clientType
+	names      map[string]bool
+	components map[string]string
+	operations []clientOperation
+}
+
+// unique - name, numbered when it is taken
+func (g *clientGenerator) unique(name string) string {
+	return uniqueName(g.names, name)
+}
+
+// uniqueName - name, numbered when it is in taken, like the fields a_b and
+// aB which are both AB
+func uniqueName(taken map[string]bool, name string) string {
+	unique := name
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s%d", name, i)
+	}
+	taken[unique] = true
+	return unique
+}
+
+// goType - the Go type of a schema, hint names the structs of inline objects
+func (g *clientGenerator) goType(ref *openapi3.SchemaRef, hint string) string {
+	if ref == nil || ref.Value == nil {
+		return "interface{}"
+	}
+	if i := strings.Index(ref.Ref, schemasRef); i >= 0 {
+		component := ref.Ref[i+len(schemasRef):]
+		if name, ok := g.components[component]; ok {
+			return name
+		}
+		name := g.unique(exportName(component))
+		g.components[component] = name
+		if g.object(name, ref.Value) {
+			return name
+		}
+		// Component schemas that aren't objects are aliases
+		alias := &clientType{Name: name}
+		g.types = append(g.types, alias)
+		alias.Alias = g.goType(&openapi3.SchemaRef{Value: ref.Value}, name+"Item")
+		return name
+	}
+
+	schema := ref.Value
+	switch schema.Type {
+	case "string":
+		return "string"
+	case "integer":
+		return "int64"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "array":
+		return "[]" + g.goType(schema.Items, hint+"Item")
+	case "object", "":
+		if len(schema.Properties) > 0 {
+			name := g.unique(hint)
+			g.object(name, schema)
+			return name
+		}
+		if schema.AdditionalProperties != nil {
+			return "map[string]" + g.goType(schema.AdditionalProperties, hint+"Value")
+		}
+		if schema.Type == "object" {
+			return "map[string]interface{}"
+		}
+	}
+	return "interface{}"
+}
+
+// object - adds a struct for an object schema, false for other schemas
+func (g *clientGenerator) object(name string, schema *openapi3.Schema) bool {
+	if len(schema.Properties) == 0 {
+		return false
+	}
+	t := &clientType{Name: name, Description: schema.Description}
+	g.types = append(g.types, t)
+
+	required := map[string]bool{}
+	for _, property := range schema.Required {
+		required[property] = true
+	}
+	properties := []string{}
+	for property := range schema.Properties {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+	fields := map[string]bool{}
+	for _, property := range properties {
+		ref := schema.Properties[property]
+		field := clientField{Name: uniqueName(fields, exportName(property)), JSON: property}
+		field.Type = g.goType(ref, name+field.Name)
+		if !required[property] || (ref.Value != nil && ref.Value.Nullable) {
+			field.JSON += ",omitempty"
+			if isScalar(field.Type) {
+				field.Type = "*" + field.Type
+			}
+		}
+		t.Fields = append(t.Fields, field)
+	}
+	return true
+}
+
+func isScalar(goType string) bool {
+	switch goType {
+	case "string", "int64", "float64", "bool":
+		return true
+	}
+	return false
+}
+
+// operationName - the operationId, or the method and path like GetNotesById
+func operationName(method string, path string, op *openapi3.Operation) string {
+	if op.OperationID != "" {
+		return exportName(op.OperationID)
+	}
+	words := []string{strings.ToLower(method)}
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") {
+			words = append(words, "by", segment)
+		} else {
+			words = append(words, segment)
+		}
+	}
+	return exportName(words...)
+}
+
+const jsonMediaType = "application/json"
+
+// mediaTypes - the media types of content, JSON first
+func mediaTypes(content openapi3.Content) []string {
+	types := []string{}
+	for mediaType := range content {
+		types = append(types, mediaType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if (types[i] == jsonMediaType) != (types[j] == jsonMediaType) {
+			return types[i] == jsonMediaType
+		}
+		return types[i] < types[j]
+	})
+	return types
+}
+
+// operation - the method of an operation
+func (g *clientGenerator) operation(method string, path string, op *openapi3.Operation, shared openapi3.Parameters) {
+	name := g.unique(operationName(method, path, op))
+	g.names[name+"Params"] = true
+	compiled := clientOperation{
+		Name:    name,
+		Summary: op.Summary,
+		Method:  method,
+		Path:    path,
+		// grest writes rows, unless the spec says otherwise
+		Result: "[]map[string]interface{}",
+		Accept: jsonMediaType,
+	}
+
+	if raw, ok := op.Extensions["x-grest"]; ok {
+		ext := struct {
+			Filter *grestFilter `json:"filter"`
+		}{}
+		if json.Unmarshal(rawExtension(raw), &ext) == nil && ext.Filter != nil {
+			compiled.Filter = true
+		}
+	}
+
+	fields := map[string]bool{"Filter": compiled.Filter}
+	for _, ref := range append(append(openapi3.Parameters{}, shared...), op.Parameters...) {
+		if ref.Value == nil || (ref.Value.In != "path" && ref.Value.In != "query" && ref.Value.In != "header") {
+			continue
+		}
+		// Operation params replace the path params they share a name with
+		if own := op.Parameters.GetByInAndName(ref.Value.In, ref.Value.Name); own != nil && own != ref.Value {
+			continue
+		}
+		param := clientParam{
+			Field: uniqueName(fields, exportName(ref.Value.Name)), Name: ref.Value.Name, In: ref.Value.In,
+		}
+		param.Type = g.goType(ref.Value.Schema, name+param.Field)
+		switch {
+		case strings.HasPrefix(param.Type, "[]"):
+			param.Kind = "slice"
+		case !ref.Value.Required && isScalar(param.Type):
+			param.Kind, param.Type = "pointer", "*"+param.Type
+		default:
+			param.Kind = "value"
+		}
+		compiled.Params = append(compiled.Params, param)
+	}
+
+	if op.RequestBody != nil && op.RequestBody.Value != nil {
+		content := op.RequestBody.Value.Content
+		if types := mediaTypes(content); len(types) > 0 && types[0] == jsonMediaType {
+			compiled.Body = g.goType(content[jsonMediaType].Schema, name+"Body")
+		} else if len(types) > 0 {
+			compiled.BodyType = types[0]
+		}
+	}
+
+	codes := []string{}
+	for code := range op.Responses {
+		if strings.HasPrefix(code, "2") {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	if len(codes) > 0 && op.Responses[codes[0]].Value != nil {
+		content := op.Responses[codes[0]].Value.Content
+		if types := mediaTypes(content); len(types) > 0 && types[0] == jsonMediaType {
+			if content[jsonMediaType].Schema != nil {
+				compiled.Result = g.goType(content[jsonMediaType].Schema, name+"Result")
+			}
+		} else if len(types) > 0 {
+			compiled.Result, compiled.Accept = "[]byte", types[0]
+		}
+	}
+	g.operations = append(g.operations, compiled)
+}
+
+// GenerateClient - Go source of a typed client of the spec, in package pkg
+func GenerateClient(swagger *openapi3.Swagger, pkg string) ([]byte, error) {
+	g := &clientGenerator{
+		names: map[string]bool{
+			"Client": true, "NewClient": true, "Error": true,
+		},
+		components: map[string]string{},
+	}
+
+	paths := []string{}
+	for path := range swagger.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		item := swagger.Paths[path]
+		for _, method := range []string{
+			http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+			http.MethodPatch, http.MethodDelete, http.MethodOptions,
+		} {
+			if op := item.GetOperation(method); op != nil {
+				g.operation(method, path, op, item.Parameters)
+			}
+		}
+	}
+	// Components no operation uses are still worth having
+	components := []string{}
+	for name := range swagger.Components.Schemas {
+		components = append(components, name)
+	}
+	sort.Strings(components)
+	for _, name := range components {
+		g.goType(&openapi3.SchemaRef{Ref: schemasRef + name, Value: swagger.Components.Schemas[name].Value}, name)
+	}
+
+	title := "the"
+	if swagger.Info != nil && swagger.Info.Title != "" {
+		title = "the " + swagger.Info.Title
+	}
+	var source bytes.Buffer
+	err := clientTemplate.Execute(&source, map[string]interface{}{
+		"package":    pkg,
+		"title":      title,
+		"types":      g.types,
+		"operations": g.operations,
+	})
+	if err != nil {
+		return nil, err
+	}
+	formatted, err := format.Source(source.Bytes())
+	if err != nil {
+		return source.Bytes(), fmt.Errorf("generated client doesn't parse : %s", err)
+	}
+	return formatted, nil
+}
+
+var clientTemplate = template.Must(template.New("client").Funcs(template.FuncMap{
+	"comment": func(text string) string {
+		return strings.Replace(strings.TrimSpace(text), "\n", "\n// ", -1)
+	},
+	"dict": func(pairs ...interface{}) map[string]interface{} {
+		dict := map[string]interface{}{}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			dict[pairs[i].(string)] = pairs[i+1]
+		}
+		return dict
+	},
+}).Parse(`// Code generated by grest client. DO NOT EDIT.
+
+package {{.package}}
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client - calls {{.title}} API
+type Client struct {
+	// BaseURL is the scheme, host and any path prefix of the server
+	BaseURL string
+	// HTTPClient sends the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// Username and Password are sent with basic auth when Username is set
+	Username string
+	Password string
+	// Token is sent as a bearer token when set
+	Token string
+}
+
+// NewClient - a client of the server at baseURL
+func NewClient(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Error - a response with an error status
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+}
+
+func jsonBody(body interface{}) (io.Reader, error) {
+	encoded, err := json.Marshal(body)
+	return bytes.NewReader(encoded), err
+}
+
+func (c *Client) do(
+	ctx context.Context, method string, path string, query url.Values, header http.Header,
+	body io.Reader, accept string, out interface{}) error {
+
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", accept)
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	} else if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		failure := struct {
+			Message string ` + "`json:\"message\"`" + `
+		}{}
+		if json.Unmarshal(message, &failure) == nil && failure.Message != "" {
+			return &Error{resp.StatusCode, failure.Message}
+		}
+		return &Error{resp.StatusCode, strings.TrimSpace(string(message))}
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+{{range .types}}
+// {{.Name}} - {{if .Description}}{{comment .Description}}{{else}}generated from the spec{{end}}
+{{- if .Alias}}
+type {{.Name}} = {{.Alias}}
+{{else}}
+type {{.Name}} struct {
+{{- range .Fields}}
+	{{.Name}} {{.Type}} ` + "`json:\"{{.JSON}}\"`" + `
+{{- end}}
+}
+{{end}}{{end}}
+{{range $op := .operations}}
+// {{.Name}}Params - the params of {{.Name}}
+type {{.Name}}Params struct {
+{{- range .Params}}
+	{{.Field}} {{.Type}}
+{{- end}}
+{{- if .Filter}}
+	// Filter holds filters like id=eq.5, sent as query params
+	Filter url.Values
+{{- end}}
+}
+
+// {{.Name}} - {{.Method}} {{.Path}}{{if .Summary}}, {{comment .Summary}}{{end}}
+func (c *Client) {{.Name}}(ctx context.Context, params {{.Name}}Params
+	{{- if .Body}}, body {{.Body}}{{else if .BodyType}}, body io.Reader{{end}}) ({{.Result}}, error) {
+	path := {{printf "%q" .Path}}
+	query := url.Values{}
+	header := http.Header{}
+{{- if .Filter}}
+	for key, values := range params.Filter {
+		query[key] = values
+	}
+{{- end}}
+{{- range .Params}}
+{{- if eq .Kind "pointer"}}
+	if params.{{.Field}} != nil {
+		{{template "param" dict "param" . "value" (printf "*params.%s" .Field)}}
+	}
+{{- else if eq .Kind "slice"}}
+	for _, value := range params.{{.Field}} {
+		{{template "param" dict "param" . "value" "value"}}
+	}
+{{- else}}
+	{{template "param" dict "param" . "value" (printf "params.%s" .Field)}}
+{{- end}}
+{{- end}}
+
+	var result {{.Result}}
+{{- if .Body}}
+	reader, err := jsonBody(body)
+	if err != nil {
+		return result, err
+	}
+	header.Set("Content-Type", "application/json")
+{{- else if .BodyType}}
+	reader := body
+	header.Set("Content-Type", {{printf "%q" .BodyType}})
+{{- else}}
+	var reader io.Reader
+{{- end}}
+	err {{if not .Body}}:{{end}}= c.do(ctx, {{printf "%q" .Method}}, path, query, header, reader, {{printf "%q" .Accept}}, &result)
+	return result, err
+}
+{{end}}
+{{- define "param"}}
+{{- if eq .param.In "path"}}path = strings.Replace(path, {{printf "{%s}" .param.Name | printf "%q"}}, url.PathEscape(fmt.Sprint({{.value}})), 1)
+{{- else if eq .param.In "query"}}query.Add({{printf "%q" .param.Name}}, fmt.Sprint({{.value}}))
+{{- else}}header.Add({{printf "%q" .param.Name}}, fmt.Sprint({{.value}}))
+{{- end}}
+{{- end}}
+`))
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Column types of each dialect, by the type name used in request bodies
+var columnTypes = map[string]map[string]string{
+	"postgres": {
+		"real":      "REAL",
+		"double":    "DOUBLE PRECISION",
+		"numeric":   "NUMERIC",
+		"text":      "TEXT",
+		"boolean":   "BOOLEAN",
+		"integer":   "INTEGER",
+		"bigint":    "BIGINT",
+		"serial":    "SERIAL",
+		"date":      "DATE",
+		"timestamp": "TIMESTAMPTZ",
+		"json":      "JSONB",
+		"bytes":     "BYTEA",
+		"uuid":      "UUID",
+	},
+	"sqlite3": {
+		"real":      "REAL",
+		"double":    "REAL",
+		"numeric":   "NUMERIC",
+		"text":      "TEXT",
+		"boolean":   "BOOLEAN",
+		"integer":   "INTEGER",
+		"bigint":    "INTEGER",
+		"serial":    "INTEGER",
+		"date":      "DATE",
+		"timestamp": "TIMESTAMP",
+		"json":      "TEXT",
+		"bytes":     "BLOB",
+		"uuid":      "TEXT",
+	},
+}
+
+// allowedTypes - the column types of the dialect limited to the whitelist
+func allowedTypes(driverName string, whitelist []string) (map[string]string, error) {
+	types := columnTypes[catalogDialect(driverName)]
+	allowed := map[string]string{}
+	for _, name := range whitelist {
+		native, ok := types[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown column type %s", name)
+		}
+		allowed[strings.ToLower(name)] = native
+	}
+	return allowed, nil
+}
+
+// columnDef - column of a CREATE TABLE body, either just the type or an
+// object with the constraints
+type columnDef struct {
+	Type string `json:"type"`
+	// Nullable defaults to true
+	Nullable   *bool       `json:"nullable"`
+	Default    interface{} `json:"default"`
+	PrimaryKey bool        `json:"primaryKey"`
+	// References is a table or {"table": ..., "column": ...}
+	References *columnReference `json:"references"`
+}
+
+type columnReference struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+}
+
+func (r *columnReference) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &r.Table); err == nil {
+		return nil
+	}
+	type plain columnReference
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// parseColumnDef - reads a body value as a column definition
+func parseColumnDef(value interface{}) (columnDef, error) {
+	def := columnDef{}
+	if name, ok := value.(string); ok {
+		def.Type = name
+		return def, nil
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return def, fmt.Errorf("%v is not a column definition", value)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return def, err
+	}
+	if err := json.Unmarshal(data, &def); err != nil {
+		return def, err
+	}
+	return def, nil
+}
+
+// columnType - the native type of an allowed column type
+func (d dialect) columnType(name interface{}) (safeSQL, error) {
+	if native, ok := d.types[strings.ToLower(fmt.Sprint(name))]; ok {
+		return safeSQL(native), nil
+	}
+	allowed := []string{}
+	for name := range d.types {
+		allowed = append(allowed, name)
+	}
+	sort.Strings(allowed)
+	return "", fmt.Errorf("column type %v must be one of %s", name, strings.Join(allowed, ", "))
+}
+
+// columnDefs - the column definitions and primary key of a CREATE TABLE
+func (d dialect) columnDefs(value interface{}) (safeSQL, error) {
+	body, ok := value.(map[string]interface{})
+	if !ok || len(body) == 0 {
+		return "", fmt.Errorf("columns must be a non empty object")
+	}
+	names, _ := names(body)
+
+	defs, keys := []string{}, []string{}
+	for _, name := range names {
+		if name == "" {
+			return "", fmt.Errorf("column names must not be empty")
+		}
+		def, err := parseColumnDef(body[name])
+		if err != nil {
+			return "", fmt.Errorf("column %s: %s", name, err)
+		}
+		native, err := d.columnType(def.Type)
+		if err != nil {
+			return "", fmt.Errorf("column %s: %s", name, err)
+		}
+
+		sql := d.ident(name) + " " + string(native)
+		if def.Nullable != nil && !*def.Nullable {
+			sql += " NOT NULL"
+		}
+		if def.Default != nil {
+			sql += " DEFAULT " + d.literal(def.Default)
+		}
+		if ref := def.References; ref != nil {
+			if ref.Table == "" {
+				return "", fmt.Errorf("column %s: references requires a table", name)
+			}
+			table := make([]string, 0, 3)
+			for _, part := range strings.Split(ref.Table, ".") {
+				table = append(table, d.ident(part))
+			}
+			sql += " REFERENCES " + strings.Join(table, ".")
+			if ref.Column != "" {
+				sql += " (" + d.ident(ref.Column) + ")"
+			}
+		}
+		if def.PrimaryKey {
+			keys = append(keys, d.ident(name))
+		}
+		defs = append(defs, sql)
+	}
+	if len(keys) > 0 {
+		defs = append(defs, "PRIMARY KEY ("+strings.Join(keys, ", ")+")")
+	}
+	return safeSQL(strings.Join(defs, ",\n")), nil
+}
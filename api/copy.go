@@ -0,0 +1,195 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/labstack/echo/v4"
+)
+
+// grestCopyFrom - x-grest copyFrom settings
+type grestCopyFrom struct {
+	// Schema and Table are templates naming the table loaded, like
+	// {{.table}}, which grest quotes. Without a schema the search path
+	// finds the table.
+	Schema  string   `json:"schema"`
+	Table   string   `json:"table"`
+	Columns []string `json:"columns"`
+	// Header skips the first line, which names the columns if none are given
+	Header bool `json:"header"`
+}
+
+// copyFrom - compiled x-grest copyFrom
+type copyFrom struct {
+	schema  *template.Template
+	table   *template.Template
+	columns []string
+	header  bool
+}
+
+func (c grestCopyFrom) compile(name string, partials *template.Template) (*copyFrom, error) {
+	if c.Table == "" {
+		return nil, fmt.Errorf("Extension x-grest copyFrom requires a table at %s", name)
+	}
+	if len(c.Columns) == 0 && !c.Header {
+		return nil, fmt.Errorf("Extension x-grest copyFrom requires columns or a header at %s", name)
+	}
+	compiled := &copyFrom{columns: c.Columns, header: c.Header}
+	var err error
+	if compiled.table, err = parsePartial(partials, name, c.Table); err != nil {
+		return nil, err
+	}
+	if c.Schema != "" {
+		if compiled.schema, err = parsePartial(partials, name, c.Schema); err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+// run - streams the CSV into the table, returning the number of rows
+func (c *copyFrom) run(txn txInterface, templateParams map[string]interface{}, body io.Reader) (int64, error) {
+	table := []string{}
+	for _, t := range []*template.Template{c.schema, c.table} {
+		if t == nil {
+			continue
+		}
+		var buffer bytes.Buffer
+		if err := t.Execute(&buffer, templateParams); err != nil {
+			log.Println("Template failed", err)
+			return 0, err
+		}
+		name := strings.TrimSpace(buffer.String())
+		if name == "" {
+			return 0, echo.NewHTTPError(http.StatusBadRequest, "copyFrom needs a table name")
+		}
+		table = append(table, name)
+	}
+
+	reader := bufio.NewReader(body)
+	columns, offset := c.columns, 0
+	if c.header {
+		// csv.Reader reads from the bufio.Reader itself, consuming the
+		// header record (quoted newlines and all) and nothing after it
+		header, err := csv.NewReader(reader).Read()
+		if err != nil {
+			return 0, copyError{1, err}
+		}
+		if len(columns) == 0 {
+			columns = header
+		}
+		offset = 1 + strings.Count(strings.Join(header, ""), "\n")
+	}
+
+	count, err := txn.CopyFrom(reader, table, columns)
+	if copyerr, ok := err.(copyError); ok && copyerr.line > 0 {
+		copyerr.line += offset
+		return count, copyerr
+	}
+	return count, err
+}
+
+// grestCopyTo - x-grest copyTo settings
+type grestCopyTo struct {
+	// Format is csv (the default) or binary
+	Format string `json:"format"`
+}
+
+func (c grestCopyTo) compile(name string) (string, error) {
+	switch c.Format {
+	case "":
+		return "csv", nil
+	case "csv", "binary":
+		return c.Format, nil
+	}
+	return "", fmt.Errorf("Extension x-grest copyTo format must be csv or binary at %s", name)
+}
+
+// exportWriter - commits the response, gzipped if accepted, on the first
+// write so that earlier errors still get an error status
+type exportWriter struct {
+	response *echo.Response
+	mime     string
+	gzip     bool
+	writer   io.Writer
+	closer   io.Closer
+}
+
+func newExportWriter(c echo.Context, format string) *exportWriter {
+	mime := mimeCSV
+	if format == "binary" {
+		mime = echo.MIMEOctetStream
+	}
+	return &exportWriter{
+		response: c.Response(),
+		mime:     mime,
+		gzip:     acceptsGzip(c.Request().Header.Get(echo.HeaderAcceptEncoding)),
+	}
+}
+
+// acceptsGzip - whether Accept-Encoding allows gzip, so gzip;q=0 doesn't
+func acceptsGzip(acceptEncoding string) bool {
+	for _, encoding := range acceptedTypes(acceptEncoding) {
+		if strings.EqualFold(encoding, "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *exportWriter) start() {
+	if e.writer != nil {
+		return
+	}
+	e.response.Header().Set(echo.HeaderContentType, e.mime)
+	e.writer = e.response
+	if e.gzip {
+		e.response.Header().Set(echo.HeaderContentEncoding, "gzip")
+		e.response.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+		writer := gzip.NewWriter(e.response)
+		e.writer, e.closer = writer, writer
+	}
+	e.response.WriteHeader(http.StatusOK)
+}
+
+func (e *exportWriter) Write(p []byte) (int, error) {
+	e.start()
+	return e.writer.Write(p)
+}
+
+func (e *exportWriter) Close() error {
+	e.start()
+	if e.closer != nil {
+		return e.closer.Close()
+	}
+	return nil
+}
+
+// export - runs the query through COPY TO STDOUT into the response
+func (api *API) export(
+	txn txInterface, query query, templateParams map[string]interface{},
+	queryParams map[string]interface{}, format string, w io.Writer) error {
+
+	var queryBuffer bytes.Buffer
+	if err := query.template.Execute(&queryBuffer, templateParams); err != nil {
+		log.Println("Template failed", err)
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	log.Println(string(queryBuffer.Bytes()))
+	if _, err := txn.CopyTo(w, string(queryBuffer.Bytes()), queryParams, format); err == errCopyFormat {
+		return echo.NewHTTPError(http.StatusNotImplemented, err.Error())
+	} else if err != nil {
+		log.Println("Failed to export query", err)
+		return errorMapping(err)
+	}
+	return nil
+}
@@ -1,13 +1,28 @@
 package api
 
 import (
+	"bufio"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 type rowsInterface interface {
 	MapScan(dest map[string]interface{}) error
+	Columns() ([]string, error)
 	Next() bool
 	Close() error
 	Scan(dest ...interface{}) error
@@ -19,11 +34,26 @@ type databaseInterface interface {
 	NamedExec(query string, arg interface{}) (sql.Result, error)
 	NamedQuery(query string, arg interface{}) (rowsInterface, error)
 	Beginx() (txInterface, error)
+	// BeginWrite starts a transaction that writes, which file backed
+	// SQLite runs one at a time
+	BeginWrite() (txInterface, error)
+	// DriverName picks the quoting dialect of the template helpers
+	DriverName() string
 }
 
 type txInterface interface {
 	NamedExec(query string, arg interface{}) (sql.Result, error)
 	NamedQuery(query string, arg interface{}) (rowsInterface, error)
+	// Exec runs statements as they are, without binding :name params
+	Exec(query string) (sql.Result, error)
+	// CopyFrom loads CSV rows into the columns of a (schema qualified) table
+	CopyFrom(r io.Reader, table []string, columns []string) (int64, error)
+	// CopyTo writes the query results as csv (with a header) or binary
+	CopyTo(w io.Writer, query string, arg interface{}, format string) (int64, error)
+	// LargeObject writes a new Postgres large object, returning its oid
+	LargeObject(r io.Reader) (uint32, error)
+	// OpenLargeObject reads a Postgres large object
+	OpenLargeObject(oid uint32) (io.ReadSeeker, error)
 	Rollback() error
 	Commit() error
 }
@@ -46,11 +76,22 @@ func (db databaseBackend) NamedExec(query string, arg interface{}) (sql.Result,
 	return db.db.NamedExec(query, arg)
 }
 
+func (db databaseBackend) DriverName() string {
+	return db.db.DriverName()
+}
+
 func (db databaseBackend) Beginx() (txInterface, error) {
+	if db.db.DriverName() == "pgx" {
+		return beginPgx(db.db)
+	}
 	txn, err := db.db.Beginx()
 	return txBackend{txn}, err
 }
 
+func (db databaseBackend) BeginWrite() (txInterface, error) {
+	return db.Beginx()
+}
+
 func (txn txBackend) NamedQuery(query string, arg interface{}) (rowsInterface, error) {
 	rows, err := txn.txn.NamedQuery(query, arg)
 	return rowsInterface(rows), err
@@ -60,6 +101,10 @@ func (txn txBackend) NamedExec(query string, arg interface{}) (sql.Result, error
 	return txn.txn.NamedExec(query, arg)
 }
 
+func (txn txBackend) Exec(query string) (sql.Result, error) {
+	return txn.txn.Exec(query)
+}
+
 func (txn txBackend) Rollback() error {
 	return txn.txn.Rollback()
 }
@@ -67,3 +112,353 @@ func (txn txBackend) Rollback() error {
 func (txn txBackend) Commit() error {
 	return txn.txn.Commit()
 }
+
+func (txn txBackend) LargeObject(r io.Reader) (uint32, error) {
+	if txn.txn.DriverName() != "postgres" {
+		return 0, errLargeObject
+	}
+	return largeObjectFromBytes(txn, r)
+}
+
+func (txn txBackend) OpenLargeObject(oid uint32) (io.ReadSeeker, error) {
+	if txn.txn.DriverName() != "postgres" {
+		return nil, errLargeObject
+	}
+	return openSQLLargeObject(txn, oid)
+}
+
+func (txn txBackend) CopyFrom(r io.Reader, table []string, columns []string) (int64, error) {
+	if txn.txn.DriverName() == "postgres" {
+		return txn.copyIn(r, table, columns)
+	}
+
+	// No COPY, so insert row by row
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	stmt, err := txn.txn.Prepare(fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s)",
+		quoteIdentifiers(table, "."), quoteIdentifiers(columns, ","), placeholders,
+	))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var count int64
+	err = readCSV(r, len(columns), func(line int, record []interface{}) error {
+		if _, err := stmt.Exec(record...); err != nil {
+			return copyError{line, err}
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func (txn txBackend) CopyTo(w io.Writer, query string, arg interface{}, format string) (int64, error) {
+	// Neither lib/pq nor sqlite can COPY TO STDOUT, so write the rows
+	if format != "csv" {
+		return 0, errCopyFormat
+	}
+	rows, err := txn.NamedQuery(query, arg)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	writer := csv.NewWriter(w)
+	if err := writer.Write(columns); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			return count, err
+		}
+		record := make([]string, len(columns))
+		for i, col := range columns {
+			record[i] = formatValue(row[col])
+		}
+		if err := writer.Write(record); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	writer.Flush()
+	return count, writer.Error()
+}
+
+// copyIn - lib/pq COPY FROM STDIN
+func (txn txBackend) copyIn(r io.Reader, table []string, columns []string) (int64, error) {
+	var copySQL string
+	if len(table) == 2 {
+		copySQL = pq.CopyInSchema(table[0], table[1], columns...)
+	} else {
+		copySQL = pq.CopyIn(strings.Join(table, "."), columns...)
+	}
+	stmt, err := txn.txn.Prepare(copySQL)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	err = readCSV(r, len(columns), func(line int, record []interface{}) error {
+		if _, err := stmt.Exec(record...); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err == nil {
+		_, err = stmt.Exec()
+	}
+	if closeErr := stmt.Close(); err == nil {
+		err = closeErr
+	}
+	if pgerr, ok := err.(*pq.Error); ok {
+		return 0, copyError{copyLine(pgerr.Where), err}
+	}
+	return count, err
+}
+
+var errCopyFormat = errors.New("binary COPY TO is only supported by pgx")
+
+// copyError - failure loading a CSV line
+type copyError struct {
+	line int
+	err  error
+}
+
+func (err copyError) Error() string {
+	return fmt.Sprintf("line %d: %s", err.line, err.err)
+}
+
+var copyLineRegex = regexp.MustCompile(`line ([0-9]+)`)
+
+// copyLine - finds the failing line in the context of a COPY error
+func copyLine(where string) int {
+	match := copyLineRegex.FindStringSubmatch(where)
+	if match == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(match[1])
+	return line
+}
+
+// readCSV - calls handle for each record of the given number of fields
+// with the line it starts on, unquoted empty fields are NULL like COPY
+func readCSV(r io.Reader, fields int, handle func(line int, record []interface{}) error) error {
+	records := csvRecords{reader: bufio.NewReader(r), line: 1}
+	for {
+		record, line, err := records.read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return copyError{line, err}
+		}
+		if len(record) != fields {
+			return copyError{line, &csv.ParseError{StartLine: line, Line: line, Err: csv.ErrFieldCount}}
+		}
+		if err := handle(line, record); err != nil {
+			return err
+		}
+	}
+}
+
+// csvRecords - reads CSV like encoding/csv, which can't tell a quoted
+// empty field, an empty string to COPY, from an unquoted one, a NULL
+type csvRecords struct {
+	reader *bufio.Reader
+	line   int
+}
+
+// read - returns the next record, nil for unquoted empty fields, and the
+// line it starts on, skipping empty lines
+func (r *csvRecords) read() ([]interface{}, int, error) {
+	record, start := []interface{}{}, r.line
+	var field strings.Builder
+	// quoted is set from the opening quote of a field, inQuotes until the
+	// closing one
+	quoted, inQuotes := false, false
+	endField := func() {
+		if quoted || field.Len() > 0 {
+			record = append(record, field.String())
+		} else {
+			record = append(record, nil)
+		}
+		field.Reset()
+		quoted = false
+	}
+	parseError := func(err error) ([]interface{}, int, error) {
+		return nil, start, &csv.ParseError{StartLine: start, Line: r.line, Err: err}
+	}
+	for {
+		b, err := r.reader.ReadByte()
+		if err == io.EOF {
+			if inQuotes {
+				return parseError(csv.ErrQuote)
+			}
+			if len(record) == 0 && !quoted && field.Len() == 0 {
+				return nil, start, io.EOF
+			}
+			endField()
+			return record, start, nil
+		} else if err != nil {
+			return nil, start, err
+		}
+
+		newline := b == '\n'
+		if b == '\r' {
+			// \r\n ends a line like \n, a lone \r is data
+			if next, err := r.reader.Peek(1); err == nil && next[0] == '\n' {
+				r.reader.ReadByte()
+				newline = true
+			}
+		}
+		switch {
+		case inQuotes && b == '"':
+			if next, err := r.reader.Peek(1); err == nil && next[0] == '"' {
+				r.reader.ReadByte()
+				field.WriteByte('"')
+			} else {
+				inQuotes = false
+			}
+		case inQuotes && newline:
+			r.line++
+			field.WriteByte('\n')
+		case inQuotes:
+			field.WriteByte(b)
+		case newline:
+			r.line++
+			if len(record) == 0 && !quoted && field.Len() == 0 {
+				start = r.line
+				continue
+			}
+			endField()
+			return record, start, nil
+		case b == ',':
+			endField()
+		case quoted:
+			// Text after the closing quote
+			return parseError(csv.ErrQuote)
+		case b == '"' && field.Len() == 0:
+			quoted, inQuotes = true, true
+		case b == '"':
+			return parseError(csv.ErrBareQuote)
+		default:
+			field.WriteByte(b)
+		}
+	}
+}
+
+func quoteIdentifiers(names []string, sep string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = pq.QuoteIdentifier(name)
+	}
+	return strings.Join(quoted, sep)
+}
+
+func copyFromSQL(table []string, columns []string) string {
+	return fmt.Sprintf(
+		"COPY %s (%s) FROM STDIN",
+		quoteIdentifiers(table, "."), quoteIdentifiers(columns, ","),
+	)
+}
+
+// inlineParams - replaces :name parameters with quoted literals for
+// statements like COPY that can't take bind parameters. sqlx resolves the
+// values, in the order of the params found by the same rules it uses, so
+// text like '$1' is left alone.
+func inlineParams(query string, arg interface{}) (string, error) {
+	_, args, err := sqlx.BindNamed(sqlx.QUESTION, query, arg)
+	if err != nil {
+		return "", err
+	}
+	literals := make([]string, len(args))
+	for i, value := range args {
+		if valuer, ok := value.(driver.Valuer); ok {
+			if value, err = valuer.Value(); err != nil {
+				return "", err
+			}
+		}
+		literals[i] = quoteLiteral(value)
+	}
+
+	var inlined strings.Builder
+	next := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != ':' {
+			inlined.WriteByte(query[i])
+			continue
+		}
+		// :: is an escaped colon
+		if i+1 < len(query) && query[i+1] == ':' {
+			inlined.WriteByte(':')
+			i++
+			continue
+		}
+		end := i + 1
+		for end < len(query) && isBindByte(query[end]) {
+			end++
+		}
+		// sqlx reads := as an assignment, dropping any name before the =
+		if end < len(query) && query[end] == '=' {
+			inlined.WriteString(":=")
+			i = end
+			continue
+		}
+		if end == len(query) {
+			// A colon ending the query isn't a param, nor is a last _ or .
+			if end == i+1 {
+				inlined.WriteByte(':')
+				continue
+			}
+			if query[end-1] == '_' || query[end-1] == '.' {
+				end--
+			}
+		}
+		if next >= len(literals) {
+			return "", fmt.Errorf("parameter %s has no value", query[i:end])
+		}
+		inlined.WriteString(literals[next])
+		next++
+		i = end - 1
+	}
+	return inlined.String(), nil
+}
+
+// isBindByte - bytes sqlx allows in :name params
+func isBindByte(b byte) bool {
+	return unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b)) || b == '_' || b == '.'
+}
+
+// quoteLiteral - Postgres literal for a parameter value
+func quoteLiteral(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if value.(bool) {
+			return "TRUE"
+		}
+		return "FALSE"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(value)
+	case float32, float64:
+		return strconv.FormatFloat(reflect.ValueOf(value).Float(), 'g', -1, 64)
+	case []byte:
+		return `'\x` + hex.EncodeToString(value.([]byte)) + `'::bytea`
+	case time.Time:
+		return pq.QuoteLiteral(value.(time.Time).Format(time.RFC3339Nano))
+	}
+	return pq.QuoteLiteral(formatValue(value))
+}
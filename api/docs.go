@@ -0,0 +1,165 @@
+package api
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/labstack/echo/v4"
+)
+
+// grestDocs - x-grest-docs on the spec, where the effective document and
+// the docs page are served. false serves neither.
+type grestDocs struct {
+	// OpenAPI is the path of the document, defaults to /openapi.json
+	OpenAPI string `json:"openapi"`
+	// Docs is the path of the page, defaults to /docs
+	Docs string `json:"docs"`
+	// Internals keeps the x-grest extensions, which show the SQL
+	Internals bool `json:"internals"`
+	// Server is the URL clients reach the API at, like
+	// https://api.example.com, replacing the servers of the spec
+	Server   string `json:"server"`
+	disabled bool
+}
+
+func (d *grestDocs) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		d.disabled = !enabled
+		return nil
+	}
+	type plain grestDocs
+	return json.Unmarshal(data, (*plain)(d))
+}
+
+// addRPCPath - documents POST /_rpc/{function}, which has no path in the spec
+func addRPCPath(swagger *openapi3.Swagger) {
+	param := openapi3.NewPathParameter("function").WithSchema(openapi3.NewStringSchema())
+	param.Description = "Function to call, in the schema of x-grest-rpc"
+	op := openapi3.NewOperation()
+	op.Summary = "Call a stored function with the body as named arguments"
+	op.AddParameter(param)
+	op.RequestBody = &openapi3.RequestBodyRef{Value: openapi3.NewRequestBody().WithJSONSchema(openapi3.NewObjectSchema())}
+	op.AddResponse(http.StatusOK, openapi3.NewResponse().WithDescription("OK"))
+	addPath(swagger, "/_rpc/{function}", &openapi3.PathItem{Post: op})
+}
+
+// addDocs - serves the spec, with the configured server if any, and Swagger
+// UI browsing it that needs nothing beyond the server
+func addDocs(e *echo.Echo, swagger *openapi3.Swagger, settings grestDocs) error {
+	if settings.disabled {
+		return nil
+	}
+	if settings.OpenAPI == "" {
+		settings.OpenAPI = "/openapi.json"
+	}
+	if settings.Docs == "" {
+		settings.Docs = "/docs"
+	}
+
+	encoded, err := json.Marshal(swagger)
+	if err != nil {
+		return err
+	}
+	var document interface{}
+	if err := json.Unmarshal(encoded, &document); err != nil {
+		return err
+	}
+	document = publicDocument(document, settings.Internals)
+	if settings.Server != "" {
+		document.(map[string]interface{})["servers"] = []map[string]string{{"url": settings.Server}}
+	}
+
+	assets := strings.TrimSuffix(settings.Docs, "/") + "/assets"
+	var page bytes.Buffer
+	if err := docsPage.Execute(&page, map[string]string{"OpenAPI": settings.OpenAPI, "Assets": assets}); err != nil {
+		return err
+	}
+
+	routes := []string{settings.OpenAPI, settings.Docs, assets + "/swagger-ui-bundle.js", assets + "/swagger-ui.css"}
+	for _, route := range routes {
+		if swagger.Paths[route] != nil {
+			return fmt.Errorf("Extension x-grest-docs path %s is taken by the spec", route)
+		}
+	}
+	e.GET(settings.OpenAPI, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, document)
+	})
+	e.GET(settings.Docs, func(c echo.Context) error {
+		return c.HTMLBlob(http.StatusOK, page.Bytes())
+	})
+	e.GET(routes[2], func(c echo.Context) error {
+		return c.Blob(http.StatusOK, "application/javascript; charset=utf-8", swaggerUIBundle)
+	})
+	e.GET(routes[3], func(c echo.Context) error {
+		return c.Blob(http.StatusOK, "text/css; charset=utf-8", swaggerUICSS)
+	})
+	return nil
+}
+
+// publicDocument - drops the x-grest extensions (unless internals are kept)
+// and points $refs into merged files at the merged components
+func publicDocument(value interface{}, internals bool) interface{} {
+	switch value.(type) {
+	case map[string]interface{}:
+		public := map[string]interface{}{}
+		for key, item := range value.(map[string]interface{}) {
+			if strings.HasPrefix(key, "x-grest") && !internals {
+				continue
+			}
+			if ref, ok := item.(string); ok && key == "$ref" {
+				if i := strings.Index(ref, "#/components/"); i > 0 {
+					item = ref[i:]
+				}
+			}
+			public[key] = publicDocument(item, internals)
+		}
+		return public
+	case []interface{}:
+		public := []interface{}{}
+		for _, item := range value.([]interface{}) {
+			public = append(public, publicDocument(item, internals))
+		}
+		return public
+	}
+	return value
+}
+
+// Swagger UI 5.18.2 (swagger-ui-dist, Apache License 2.0, see
+// swagger-ui/LICENSE), served by the docs page so it works offline
+var (
+	//go:embed swagger-ui/swagger-ui-bundle.js
+	swaggerUIBundle []byte
+	//go:embed swagger-ui/swagger-ui.css
+	swaggerUICSS []byte
+)
+
+// The docs page, Swagger UI rendering the document
+var docsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>API docs</title>
+<link rel="stylesheet" href="{{.Assets}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.Assets}}/swagger-ui-bundle.js"></script>
+<script>
+window.ui = SwaggerUIBundle({
+  url: {{.OpenAPI}},
+  dom_id: "#swagger-ui",
+  deepLinking: true,
+  presets: [SwaggerUIBundle.presets.apis],
+  layout: "BaseLayout"
+});
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,347 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Foreign keys between a table and the tables the current role may read,
+// one row per column pair
+const foreignKeysQuery = `SELECT k.conname AS name,
+		n.nspname AS schema, c.relname AS table_name, a.attname AS column_name,
+		rn.nspname AS ref_schema, rc.relname AS ref_table, ra.attname AS ref_column
+	FROM pg_catalog.pg_constraint AS k
+	JOIN pg_catalog.pg_class AS c ON c.oid = k.conrelid
+	JOIN pg_catalog.pg_namespace AS n ON n.oid = c.relnamespace
+	JOIN pg_catalog.pg_class AS rc ON rc.oid = k.confrelid
+	JOIN pg_catalog.pg_namespace AS rn ON rn.oid = rc.relnamespace
+	CROSS JOIN LATERAL unnest(k.conkey, k.confkey) WITH ORDINALITY AS u(attnum, ref_attnum, position)
+	JOIN pg_catalog.pg_attribute AS a ON a.attrelid = k.conrelid AND a.attnum = u.attnum
+	JOIN pg_catalog.pg_attribute AS ra ON ra.attrelid = k.confrelid AND ra.attnum = u.ref_attnum
+	WHERE k.contype = 'f'
+		AND ((n.nspname = :schema AND c.relname = :table) OR (rn.nspname = :schema AND rc.relname = :table))
+		AND has_table_privilege(c.oid, 'SELECT') AND has_table_privilege(rc.oid, 'SELECT')
+	ORDER BY k.conname, u.position`
+
+// grestSelect - x-grest select, the select param picks the columns read and
+// embeds related rows, the templates print it with {{join ", " ._select}}
+type grestSelect struct {
+	// Param is the query param, defaults to select
+	Param string `json:"param"`
+	// Schema and Table are templates naming the table read, like {{.table}}
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+}
+
+// selection - compiled x-grest select
+type selection struct {
+	param  string
+	schema *template.Template
+	table  *template.Template
+}
+
+func (s *grestSelect) compile(name string) (*selection, error) {
+	if s.Table == "" {
+		return nil, fmt.Errorf("Extension x-grest select requires a table at %s", name)
+	}
+	compiled := &selection{param: s.Param}
+	if compiled.param == "" {
+		compiled.param = "select"
+	}
+	schema := s.Schema
+	if schema == "" {
+		schema = "public"
+	}
+	var err error
+	if compiled.table, err = template.New(name).Parse(s.Table); err != nil {
+		return nil, err
+	}
+	if compiled.schema, err = template.New(name).Parse(schema); err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+// selectItem - a column, * or an embedded relation of ?select=
+type selectItem struct {
+	name string
+	// embed lists the items of an embedded relation, nil for columns
+	embed []selectItem
+}
+
+// parseSelect - parses a list like *,lines(*,product(name)),customer(name)
+func parseSelect(value string) ([]selectItem, error) {
+	items, rest, err := parseSelectList(value)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %s in select", rest)
+	}
+	return items, nil
+}
+
+func parseSelectList(value string) ([]selectItem, string, error) {
+	items := []selectItem{}
+	for {
+		end := strings.IndexAny(value, ",()")
+		if end < 0 {
+			end = len(value)
+		}
+		item := selectItem{name: strings.TrimSpace(value[:end])}
+		if item.name == "" {
+			return nil, "", fmt.Errorf("empty name in select")
+		}
+		value = value[end:]
+		if strings.HasPrefix(value, "(") {
+			if item.name == "*" {
+				return nil, "", fmt.Errorf("* can't be embedded")
+			}
+			var err error
+			if item.embed, value, err = parseSelectList(value[1:]); err != nil {
+				return nil, "", err
+			}
+			if !strings.HasPrefix(value, ")") {
+				return nil, "", fmt.Errorf("missing ) after %s in select", item.name)
+			}
+			value = value[1:]
+		}
+		items = append(items, item)
+		if !strings.HasPrefix(value, ",") {
+			return items, value, nil
+		}
+		value = value[1:]
+	}
+}
+
+// foreignKey - a foreign key constraint, columns of table reference the
+// refColumns of refTable
+type foreignKey struct {
+	name                string
+	schema, table       string
+	refSchema, refTable string
+	columns, refColumns []string
+}
+
+// relation - how an embedded table joins the table it is embedded in
+type relation struct {
+	schema, table string
+	// many is set when several rows reference the outer row
+	many bool
+	// inner columns equal the outer columns
+	inner, outer []string
+}
+
+// relate - the relation named by an embed, a related table, a foreign key
+// column or a constraint name
+func relate(keys []foreignKey, schema string, table string, name string) (relation, error) {
+	found := []relation{}
+	for _, key := range keys {
+		if key.schema == schema && key.table == table &&
+			(key.refTable == name || key.name == name || (len(key.columns) == 1 && key.columns[0] == name)) {
+			found = append(found, relation{key.refSchema, key.refTable, false, key.refColumns, key.columns})
+		}
+		if key.refSchema == schema && key.refTable == table && (key.table == name || key.name == name) {
+			found = append(found, relation{key.schema, key.table, true, key.columns, key.refColumns})
+		}
+	}
+	switch len(found) {
+	case 0:
+		return relation{}, echo.NewHTTPError(
+			http.StatusBadRequest, fmt.Sprintf("No relation between %s and %s", table, name),
+		)
+	case 1:
+		return found[0], nil
+	}
+	return relation{}, echo.NewHTTPError(
+		http.StatusBadRequest,
+		fmt.Sprintf("Relation between %s and %s is ambiguous, embed the constraint name", table, name),
+	)
+}
+
+// embedder - builds the select list, loading foreign keys as the role
+type embedder struct {
+	quoting dialect
+	load    func(schema string, table string) ([]foreignKey, error)
+	aliases int
+}
+
+// selectList - the select items for table, referenced in SQL as outer
+func (e *embedder) selectList(items []selectItem, schema string, table string, outer string) ([]safeSQL, error) {
+	list := []safeSQL{}
+	var keys []foreignKey
+	for _, item := range items {
+		if item.embed == nil {
+			if item.name == "*" {
+				list = append(list, safeSQL(outer+".*"))
+			} else {
+				list = append(list, safeSQL(outer+"."+e.quoting.ident(item.name)))
+			}
+			continue
+		}
+
+		if keys == nil {
+			var err error
+			if keys, err = e.load(schema, table); err != nil {
+				return nil, err
+			}
+		}
+		rel, err := relate(keys, schema, table, item.name)
+		if err != nil {
+			return nil, err
+		}
+		e.aliases++
+		alias := e.quoting.ident(fmt.Sprintf("e%d", e.aliases))
+		rows := e.quoting.ident(fmt.Sprintf("j%d", e.aliases))
+		inner, err := e.selectList(item.embed, rel.schema, rel.table, alias)
+		if err != nil {
+			return nil, err
+		}
+		join := make([]string, len(rel.inner))
+		for i := range rel.inner {
+			join[i] = alias + "." + e.quoting.ident(rel.inner[i]) + " = " + outer + "." + e.quoting.ident(rel.outer[i])
+		}
+		aggregate := "row_to_json(" + rows + ")"
+		if rel.many {
+			aggregate = "COALESCE(json_agg(" + rows + "), '[]')"
+		}
+		list = append(list, safeSQL(fmt.Sprintf(
+			"(SELECT %s FROM (SELECT %s FROM %s.%s AS %s WHERE %s) AS %s) AS %s",
+			aggregate, joinSQL(inner), e.quoting.ident(rel.schema), e.quoting.ident(rel.table),
+			alias, strings.Join(join, " AND "), rows, e.quoting.ident(item.name),
+		)))
+	}
+	return list, nil
+}
+
+func joinSQL(list []safeSQL) string {
+	items := make([]string, len(list))
+	for i, item := range list {
+		items[i] = string(item)
+	}
+	return strings.Join(items, ", ")
+}
+
+// loadForeignKeys - the foreign keys from or to a table the role can read
+func loadForeignKeys(txn txInterface, schema string, table string) ([]foreignKey, error) {
+	rows, err := txn.NamedQuery(foreignKeysQuery, map[string]interface{}{"schema": schema, "table": table})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []foreignKey{}
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			return nil, err
+		}
+		name := formatValue(row["name"])
+		owner := formatValue(row["schema"]) + "." + formatValue(row["table_name"])
+		if n := len(keys); n == 0 || keys[n-1].name != name || keys[n-1].schema+"."+keys[n-1].table != owner {
+			keys = append(keys, foreignKey{
+				name:      name,
+				schema:    formatValue(row["schema"]),
+				table:     formatValue(row["table_name"]),
+				refSchema: formatValue(row["ref_schema"]),
+				refTable:  formatValue(row["ref_table"]),
+			})
+		}
+		key := &keys[len(keys)-1]
+		key.columns = append(key.columns, formatValue(row["column_name"]))
+		key.refColumns = append(key.refColumns, formatValue(row["ref_column"]))
+	}
+	return keys, rows.Err()
+}
+
+// selectColumns - the ._select list of the request and the names of the
+// embedded columns, * unless the select param is given
+func (api *API) selectColumns(
+	txn txInterface, s *selection, templateParams map[string]interface{},
+	params map[string]interface{}) ([]safeSQL, []string, error) {
+
+	render := func(t *template.Template) (string, error) {
+		var buffer bytes.Buffer
+		if err := t.Execute(&buffer, templateParams); err != nil {
+			return "", echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return buffer.String(), nil
+	}
+	schema, err := render(s.schema)
+	if err != nil {
+		return nil, nil, err
+	}
+	table, err := render(s.table)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	value := formatValue(params[s.param])
+	if value == "" {
+		value = "*"
+	}
+	items, err := parseSelect(value)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	dialect := catalogDialect(api.sql.DriverName())
+	embedded := []string{}
+	for _, item := range items {
+		if item.embed != nil {
+			embedded = append(embedded, item.name)
+		}
+	}
+	if len(embedded) > 0 && dialect != "postgres" {
+		return nil, nil, echo.NewHTTPError(http.StatusNotImplemented, "Embedding requires Postgres")
+	}
+
+	e := &embedder{
+		quoting: dialectOf(dialect),
+		load: func(schema string, table string) ([]foreignKey, error) {
+			keys, err := loadForeignKeys(txn, schema, table)
+			if err != nil {
+				log.Println("Failed to load foreign keys", err)
+				return nil, errorMapping(err)
+			}
+			return keys, nil
+		},
+	}
+	// The bare table name, as SQLite can't qualify * with the schema
+	list, err := e.selectList(items, schema, table, e.quoting.ident(table))
+	return list, embedded, err
+}
+
+// embedEncoder - decodes the JSON of embedded columns, so they are nested
+// in the response instead of strings
+type embedEncoder struct {
+	encoder
+	columns []string
+}
+
+func (e *embedEncoder) Encode(row map[string]interface{}) error {
+	for _, column := range e.columns {
+		var raw []byte
+		switch row[column].(type) {
+		case []byte:
+			raw = row[column].([]byte)
+		case string:
+			raw = []byte(row[column].(string))
+		default:
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		row[column] = value
+	}
+	return e.encoder.Encode(row)
+}
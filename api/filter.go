@@ -0,0 +1,108 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// grestFilter - x-grest filter, query params like ?id=eq.5 that the spec
+// doesn't declare filter the rows, printed with {{join " AND " ._where}}
+type grestFilter struct {
+	// Unfiltered allows requests without any filter, which would update or
+	// delete every row
+	Unfiltered bool `json:"unfiltered"`
+}
+
+// Query params read by the handler itself, so they never filter
+var reservedQuery = map[string]bool{"format": true, "on_conflict": true}
+
+var filterOperators = map[string]string{
+	"eq": "=", "neq": "<>", "gt": ">", "gte": ">=", "lt": "<", "lte": "<=",
+	"like": "LIKE", "ilike": "ILIKE",
+}
+
+// parseFilters - the conditions of the filter params, their values are
+// bound as :_filter.0, :_filter.1 ...
+func parseFilters(query url.Values, declared map[string]bool, dialect string) (
+	[]safeSQL, map[string]interface{}, error) {
+
+	columns := []string{}
+	for column := range query {
+		if !declared[column] && !reservedQuery[column] {
+			columns = append(columns, column)
+		}
+	}
+	sort.Strings(columns)
+
+	quoting := dialectOf(dialect)
+	where, params := []safeSQL{}, map[string]interface{}{}
+	bind := func(value string) string {
+		name := fmt.Sprintf("_filter.%d", len(params))
+		params[name] = value
+		return ":" + name
+	}
+	for _, column := range columns {
+		for _, filter := range query[column] {
+			sql, err := parseFilter(quoting.ident(column), filter, dialect, bind)
+			if err != nil {
+				return nil, nil, echo.NewHTTPError(
+					http.StatusBadRequest, fmt.Sprintf("Filter %s=%s : %s", column, filter, err),
+				)
+			}
+			where = append(where, safeSQL(sql))
+		}
+	}
+	return where, params, nil
+}
+
+// parseFilter - a condition like eq.5, in.(1,2), is.null or not.like.a*
+func parseFilter(column string, filter string, dialect string, bind func(string) string) (string, error) {
+	if strings.HasPrefix(filter, "not.") {
+		sql, err := parseFilter(column, strings.TrimPrefix(filter, "not."), dialect, bind)
+		return "NOT (" + sql + ")", err
+	}
+	parts := strings.SplitN(filter, ".", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("filters look like operator.value")
+	}
+	operator, value := parts[0], parts[1]
+
+	switch operator {
+	case "is":
+		switch value {
+		case "null":
+			return column + " IS NULL", nil
+		case "true":
+			return column + " IS TRUE", nil
+		case "false":
+			return column + " IS FALSE", nil
+		}
+		return "", fmt.Errorf("is takes null, true or false")
+	case "in":
+		if !strings.HasPrefix(value, "(") || !strings.HasSuffix(value, ")") {
+			return "", fmt.Errorf("in takes a list like (1,2)")
+		}
+		values := strings.Split(value[1:len(value)-1], ",")
+		for i := range values {
+			values[i] = bind(values[i])
+		}
+		return column + " IN (" + strings.Join(values, ", ") + ")", nil
+	case "like", "ilike":
+		// * is easier than %, which must be escaped in URLs
+		value = strings.Replace(value, "*", "%", -1)
+		if dialect == "sqlite3" {
+			// LIKE ignores case on SQLite already
+			operator = "like"
+		}
+	}
+	sql, ok := filterOperators[operator]
+	if !ok {
+		return "", fmt.Errorf("unknown operator %s", operator)
+	}
+	return column + " " + sql + " " + bind(value), nil
+}
@@ -0,0 +1,496 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	mimeNDJSON = "application/x-ndjson"
+	mimeArrow  = "application/vnd.apache.arrow.stream"
+	mimeCSV    = "text/csv"
+	mimeText   = echo.MIMETextPlain
+)
+
+// Short names accepted by ?format=
+var formatNames = map[string]string{
+	"json":   echo.MIMEApplicationJSON,
+	"ndjson": mimeNDJSON,
+	"csv":    mimeCSV,
+	"arrow":  mimeArrow,
+	"text":   mimeText,
+}
+
+var encoders = map[string]func(w *echo.Response) encoder{
+	echo.MIMEApplicationJSON: func(w *echo.Response) encoder { return &jsonEncoder{w: w} },
+	mimeNDJSON:               func(w *echo.Response) encoder { return &ndjsonEncoder{w: w} },
+	mimeCSV:                  func(w *echo.Response) encoder { return &csvEncoder{w: w} },
+	mimeArrow:                func(w *echo.Response) encoder { return &arrowEncoder{w: w} },
+	mimeText:                 func(w *echo.Response) encoder { return &textEncoder{w: w} },
+}
+
+// encoder - writes the rows of the final query to the response
+type encoder interface {
+	// Begin is called before the rows of each query execution
+	Begin(columns []string) error
+	Encode(row map[string]interface{}) error
+	// End is called once, even when no rows were returned
+	End() error
+}
+
+// responseFormats - content types declared on the 200 response, if any
+func responseFormats(responses openapi3.Responses) []string {
+	formats := []string{}
+	if response, ok := responses["200"]; ok && response.Value != nil {
+		for mime := range response.Value.Content {
+			if _, ok := encoders[mime]; !ok {
+				continue
+			}
+			formats = append(formats, mime)
+		}
+	}
+	sort.Slice(formats, func(i, j int) bool {
+		// JSON stays the default when declared
+		return formats[i] == echo.MIMEApplicationJSON ||
+			(formats[j] != echo.MIMEApplicationJSON && formats[i] < formats[j])
+	})
+	return formats
+}
+
+// negotiate - picks an encoder from ?format= or Accept, limited to the
+// formats declared by the operation
+func negotiate(c echo.Context, declared []string) (encoder, error) {
+	allowed := declared
+	if len(allowed) == 0 {
+		allowed = []string{echo.MIMEApplicationJSON, mimeNDJSON, mimeCSV, mimeArrow, mimeText}
+	}
+	isAllowed := func(mime string) bool {
+		for _, format := range allowed {
+			if format == mime {
+				return true
+			}
+		}
+		return false
+	}
+
+	if format := c.QueryParam("format"); format != "" {
+		mime, ok := formatNames[format]
+		if !ok {
+			mime = format
+		}
+		if !isAllowed(mime) {
+			return nil, echo.NewHTTPError(
+				http.StatusNotAcceptable, fmt.Sprintf("Format %s is not available", format),
+			)
+		}
+		return encoders[mime](c.Response()), nil
+	}
+
+	accept := c.Request().Header.Get(echo.HeaderAccept)
+	if accept == "" {
+		return encoders[allowed[0]](c.Response()), nil
+	}
+	for _, mediaRange := range acceptedTypes(accept) {
+		for _, mime := range allowed {
+			if mediaMatches(mediaRange, mime) {
+				return encoders[mime](c.Response()), nil
+			}
+		}
+	}
+	return nil, echo.NewHTTPError(
+		http.StatusNotAcceptable, fmt.Sprintf("None of %s are available", accept),
+	)
+}
+
+// mediaMatches - whether a media range of Accept, like text/csv, text/* or
+// */*, covers the type
+func mediaMatches(mediaRange string, mime string) bool {
+	mediaRange = strings.ToLower(mediaRange)
+	if mediaRange == "*/*" || mediaRange == mime {
+		return true
+	}
+	return strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mime, strings.TrimSuffix(mediaRange, "*"))
+}
+
+// acceptedTypes - media types of an Accept header (or the encodings of
+// Accept-Encoding) by descending quality, leaving out q=0
+func acceptedTypes(accept string) []string {
+	type accepted struct {
+		mime    string
+		quality float64
+	}
+	types := []accepted{}
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		entry := accepted{strings.TrimSpace(fields[0]), 1}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					entry.quality = q
+				}
+			}
+		}
+		if entry.quality > 0 {
+			types = append(types, entry)
+		}
+	}
+	sort.SliceStable(types, func(i, j int) bool { return types[i].quality > types[j].quality })
+
+	mimes := make([]string, len(types))
+	for i, entry := range types {
+		mimes[i] = entry.mime
+	}
+	return mimes
+}
+
+// formatValue - text form of a value for CSV and plain text
+func formatValue(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(value.([]byte))
+	case time.Time:
+		return value.(time.Time).Format(time.RFC3339Nano)
+	case string:
+		return value.(string)
+	}
+	return fmt.Sprint(value)
+}
+
+func startResponse(w *echo.Response, mime string) {
+	if !w.Committed {
+		w.Header().Set(echo.HeaderContentType, mime)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// bufferedResponse - holds the response of an operation that writes until
+// its transaction commits, so clients never get rows that were rolled back
+// or a 200 cut short by a later error
+type bufferedResponse struct {
+	response *echo.Response
+	writer   http.ResponseWriter
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+}
+
+func bufferResponse(response *echo.Response) *bufferedResponse {
+	b := &bufferedResponse{response: response, writer: response.Writer, header: http.Header{}}
+	for key, values := range response.Writer.Header() {
+		b.header[key] = values
+	}
+	response.Writer = b
+	return b
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+// Flush - nothing is sent before finish
+func (b *bufferedResponse) Flush() {}
+
+// finish - sends the buffered response, or drops it when the operation
+// failed so the error is written in its place
+func (b *bufferedResponse) finish(err error) error {
+	b.response.Writer = b.writer
+	if err != nil {
+		b.response.Committed, b.response.Status, b.response.Size = false, http.StatusOK, 0
+		return err
+	}
+	if !b.response.Committed {
+		return nil
+	}
+	for key, values := range b.header {
+		b.writer.Header()[key] = values
+	}
+	b.writer.WriteHeader(b.status)
+	_, err = b.writer.Write(b.body.Bytes())
+	return err
+}
+
+// The encoders only commit the response on the first row or at the end, so
+// errors raised while fetching the first row still get an error status.
+// Operations that write are buffered whole by bufferedResponse.
+
+type jsonEncoder struct {
+	w     *echo.Response
+	count int
+}
+
+func (e *jsonEncoder) Begin(columns []string) error {
+	return nil
+}
+
+func (e *jsonEncoder) start() error {
+	if !e.w.Committed {
+		startResponse(e.w, echo.MIMEApplicationJSONCharsetUTF8)
+		_, err := e.w.Write([]byte("["))
+		return err
+	}
+	return nil
+}
+
+func (e *jsonEncoder) Encode(row map[string]interface{}) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	if e.count > 0 {
+		if _, err := e.w.Write([]byte(",")); err != nil {
+			return err
+		}
+	}
+	e.count++
+	return json.NewEncoder(e.w).Encode(row)
+}
+
+func (e *jsonEncoder) End() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	_, err := e.w.Write([]byte("]\n"))
+	return err
+}
+
+type ndjsonEncoder struct {
+	w *echo.Response
+}
+
+func (e *ndjsonEncoder) Begin(columns []string) error {
+	return nil
+}
+
+func (e *ndjsonEncoder) Encode(row map[string]interface{}) error {
+	startResponse(e.w, mimeNDJSON)
+	return json.NewEncoder(e.w).Encode(row)
+}
+
+func (e *ndjsonEncoder) End() error {
+	startResponse(e.w, mimeNDJSON)
+	return nil
+}
+
+type csvEncoder struct {
+	w       *echo.Response
+	csv     *csv.Writer
+	columns []string
+}
+
+func (e *csvEncoder) Begin(columns []string) error {
+	if e.columns == nil {
+		e.columns = columns
+	}
+	return nil
+}
+
+func (e *csvEncoder) start() error {
+	if e.csv != nil {
+		return nil
+	}
+	startResponse(e.w, mimeCSV)
+	e.csv = csv.NewWriter(e.w)
+	if len(e.columns) == 0 {
+		return nil
+	}
+	return e.csv.Write(e.columns)
+}
+
+func (e *csvEncoder) Encode(row map[string]interface{}) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	record := make([]string, len(e.columns))
+	for i, col := range e.columns {
+		record[i] = formatValue(row[col])
+	}
+	return e.csv.Write(record)
+}
+
+func (e *csvEncoder) End() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	e.csv.Flush()
+	return e.csv.Error()
+}
+
+// textEncoder - a single scalar, so nothing is written until the end
+type textEncoder struct {
+	w       *echo.Response
+	columns []string
+	rows    []map[string]interface{}
+}
+
+func (e *textEncoder) Begin(columns []string) error {
+	e.columns = columns
+	return nil
+}
+
+func (e *textEncoder) Encode(row map[string]interface{}) error {
+	e.rows = append(e.rows, row)
+	return nil
+}
+
+func (e *textEncoder) End() error {
+	if len(e.rows) != 1 || len(e.columns) != 1 {
+		return echo.NewHTTPError(
+			http.StatusNotAcceptable, "text/plain is only available for a single scalar result",
+		)
+	}
+	startResponse(e.w, echo.MIMETextPlainCharsetUTF8)
+	_, err := io.WriteString(e.w, formatValue(e.rows[0][e.columns[0]]))
+	return err
+}
+
+// Rows per Arrow record batch
+const arrowBatchSize = 1024
+
+// arrowEncoder - Arrow needs the schema before the first batch, and a later
+// row may widen a column (integers then floats, or mixed values to text),
+// so the rows are held until End settles the schema
+type arrowEncoder struct {
+	w       *echo.Response
+	columns []string
+	rows    []map[string]interface{}
+	types   map[string]arrow.DataType
+}
+
+func (e *arrowEncoder) Begin(columns []string) error {
+	if e.columns == nil {
+		e.columns = columns
+		e.types = map[string]arrow.DataType{}
+	}
+	return nil
+}
+
+func (e *arrowEncoder) Encode(row map[string]interface{}) error {
+	e.rows = append(e.rows, row)
+	for _, col := range e.columns {
+		e.types[col] = widenArrow(e.types[col], row[col])
+	}
+	return nil
+}
+
+func (e *arrowEncoder) End() error {
+	fields := make([]arrow.Field, len(e.columns))
+	for i, col := range e.columns {
+		fields[i] = arrow.Field{Name: col, Type: e.types[col], Nullable: true}
+		if fields[i].Type == nil {
+			// Only nulls
+			fields[i].Type = arrow.BinaryTypes.String
+		}
+	}
+	schema := arrow.NewSchema(fields, nil)
+	mem := memory.NewGoAllocator()
+	builder := array.NewRecordBuilder(mem, schema)
+	defer builder.Release()
+	startResponse(e.w, mimeArrow)
+	writer := ipc.NewWriter(e.w, ipc.WithSchema(schema), ipc.WithAllocator(mem))
+
+	for start := 0; start < len(e.rows); start += arrowBatchSize {
+		end := start + arrowBatchSize
+		if end > len(e.rows) {
+			end = len(e.rows)
+		}
+		for _, row := range e.rows[start:end] {
+			for i, col := range e.columns {
+				if err := appendArrow(builder.Field(i), row[col]); err != nil {
+					return fmt.Errorf("column %s: %s", col, err)
+				}
+			}
+		}
+		record := builder.NewRecord()
+		err := writer.Write(record)
+		record.Release()
+		if err != nil {
+			return err
+		}
+	}
+	e.rows = nil
+	return writer.Close()
+}
+
+// widenArrow - the Arrow type holding both the values seen so far, of type
+// current (nil before any), and value
+func widenArrow(current arrow.DataType, value interface{}) arrow.DataType {
+	var next arrow.DataType = arrow.BinaryTypes.String
+	switch value.(type) {
+	case nil:
+		return current
+	case bool:
+		next = arrow.FixedWidthTypes.Boolean
+	case int, int8, int16, int32, int64:
+		next = arrow.PrimitiveTypes.Int64
+	case float32, float64:
+		next = arrow.PrimitiveTypes.Float64
+	case time.Time:
+		next = arrow.FixedWidthTypes.Timestamp_us
+	}
+	switch {
+	case current == nil || arrow.TypeEqual(current, next):
+		return next
+	case current.ID() == arrow.INT64 && next.ID() == arrow.FLOAT64,
+		current.ID() == arrow.FLOAT64 && next.ID() == arrow.INT64:
+		return arrow.PrimitiveTypes.Float64
+	}
+	return arrow.BinaryTypes.String
+}
+
+func appendArrow(builder array.Builder, value interface{}) error {
+	if value == nil {
+		builder.AppendNull()
+		return nil
+	}
+	switch builder.(type) {
+	case *array.BooleanBuilder:
+		if v, ok := value.(bool); ok {
+			builder.(*array.BooleanBuilder).Append(v)
+			return nil
+		}
+	case *array.Int64Builder:
+		if v, err := strconv.ParseInt(fmt.Sprint(value), 10, 64); err == nil {
+			builder.(*array.Int64Builder).Append(v)
+			return nil
+		}
+	case *array.Float64Builder:
+		if v, err := strconv.ParseFloat(fmt.Sprint(value), 64); err == nil {
+			builder.(*array.Float64Builder).Append(v)
+			return nil
+		}
+	case *array.TimestampBuilder:
+		if v, ok := value.(time.Time); ok {
+			builder.(*array.TimestampBuilder).Append(arrow.Timestamp(v.UnixNano() / 1000))
+			return nil
+		}
+	case *array.StringBuilder:
+		builder.(*array.StringBuilder).Append(formatValue(value))
+		return nil
+	}
+	return fmt.Errorf("unexpected %T value %v", value, value)
+}
@@ -0,0 +1,503 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// Rows per page of generated list operations unless ?limit= is given
+const defaultPageSize = 100
+
+// Most rows per page of generated list operations unless configured
+const defaultMaxPageSize = 1000
+
+// Functions taking the smaller of two values, capping ?limit=
+var leastFunc = map[string]string{"postgres": "LEAST", "sqlite3": "MIN"}
+
+// Queries describing the tables of a schema for GenerateSpec, one row per
+// column with key_position > 0 for primary key columns, and one row per
+// foreign key column
+var introspectQueries = map[string]map[string]string{
+	"postgres": {
+		"columns": `SELECT c.relname AS table_name, c.relkind IN ('v', 'm') AS is_view,
+				COALESCE(obj_description(c.oid, 'pg_class'), '') AS table_comment,
+				a.attname AS column_name, format_type(a.atttypid, a.atttypmod) AS column_type,
+				NOT a.attnotnull AS nullable, a.atthasdef AS has_default,
+				COALESCE(col_description(c.oid, a.attnum), '') AS column_comment,
+				COALESCE(array_position(k.conkey, a.attnum), 0) AS key_position
+			FROM pg_catalog.pg_class AS c
+			JOIN pg_catalog.pg_namespace AS n ON n.oid = c.relnamespace
+			JOIN pg_catalog.pg_attribute AS a
+				ON a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+			LEFT JOIN pg_catalog.pg_constraint AS k ON k.conrelid = c.oid AND k.contype = 'p'
+			WHERE n.nspname = :schema AND c.relkind IN ('r', 'p', 'v', 'm')
+			ORDER BY c.relname, a.attnum`,
+		"foreignKeys": `SELECT c.relname AS table_name, a.attname AS column_name,
+				rn.nspname || '.' || rc.relname AS ref_table, ra.attname AS ref_column
+			FROM pg_catalog.pg_constraint AS k
+			JOIN pg_catalog.pg_class AS c ON c.oid = k.conrelid
+			JOIN pg_catalog.pg_namespace AS n ON n.oid = c.relnamespace
+			JOIN pg_catalog.pg_class AS rc ON rc.oid = k.confrelid
+			JOIN pg_catalog.pg_namespace AS rn ON rn.oid = rc.relnamespace
+			CROSS JOIN LATERAL unnest(k.conkey, k.confkey) AS u(attnum, ref_attnum)
+			JOIN pg_catalog.pg_attribute AS a ON a.attrelid = k.conrelid AND a.attnum = u.attnum
+			JOIN pg_catalog.pg_attribute AS ra ON ra.attrelid = k.confrelid AND ra.attnum = u.ref_attnum
+			WHERE k.contype = 'f' AND n.nspname = :schema`,
+	},
+	"sqlite3": {
+		"columns": `SELECT m.name AS table_name, m.type = 'view' AS is_view,
+				'' AS table_comment, p.name AS column_name, p.type AS column_type,
+				NOT p."notnull" AS nullable, p.dflt_value IS NOT NULL AS has_default,
+				'' AS column_comment, p.pk AS key_position
+			FROM sqlite_master AS m, pragma_table_info(m.name) AS p
+			WHERE m.type IN ('table', 'view') AND m.name NOT LIKE 'sqlite_%'
+			ORDER BY m.name, p.cid`,
+		"foreignKeys": `SELECT m.name AS table_name, f."from" AS column_name,
+				'main.' || f."table" AS ref_table, COALESCE(f."to", '') AS ref_column
+			FROM sqlite_master AS m, pragma_foreign_key_list(m.name) AS f
+			WHERE m.type = 'table'`,
+	},
+}
+
+// Path params of generated operations must be plain names and can't shadow
+// the template params bound by the handler
+var keyParam = regexp.MustCompile(sanitizeRegex)
+
+var reservedParams = map[string]bool{"body": true, "rows": true, "onConflict": true}
+
+// Tables become path segments, so only plain names are generated
+var pathName = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+// tableInfo - a table or view of the introspected schema
+type tableInfo struct {
+	schema  string
+	name    string
+	comment string
+	view    bool
+	columns []columnInfo
+	// keys are the primary key columns in order
+	keys []string
+}
+
+type columnInfo struct {
+	name       string
+	typ        string
+	comment    string
+	nullable   bool
+	hasDefault bool
+	references *columnReference
+}
+
+// truthy - booleans from either dialect, SQLite has integers
+func truthy(value interface{}) bool {
+	switch formatValue(value) {
+	case "true", "1", "t":
+		return true
+	}
+	return false
+}
+
+// introspect - the tables and views of schema, in name order
+func (api *API) introspect(schema string) ([]tableInfo, error) {
+	queries := introspectQueries[catalogDialect(api.sql.DriverName())]
+	params := map[string]interface{}{"schema": schema}
+
+	rows, err := api.sql.NamedQuery(queries["columns"], params)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := []tableInfo{}
+	keys := map[string]map[int]string{}
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			return nil, err
+		}
+		name := formatValue(row["table_name"])
+		if len(tables) == 0 || tables[len(tables)-1].name != name {
+			tables = append(tables, tableInfo{
+				schema:  schema,
+				name:    name,
+				comment: formatValue(row["table_comment"]),
+				view:    truthy(row["is_view"]),
+			})
+			keys[name] = map[int]string{}
+		}
+		table := &tables[len(tables)-1]
+		column := columnInfo{
+			name:       formatValue(row["column_name"]),
+			typ:        formatValue(row["column_type"]),
+			comment:    formatValue(row["column_comment"]),
+			nullable:   truthy(row["nullable"]),
+			hasDefault: truthy(row["has_default"]),
+		}
+		table.columns = append(table.columns, column)
+		position := 0
+		fmt.Sscan(formatValue(row["key_position"]), &position)
+		if position > 0 {
+			keys[name][position] = column.name
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range tables {
+		for position := 1; position <= len(keys[tables[i].name]); position++ {
+			tables[i].keys = append(tables[i].keys, keys[tables[i].name][position])
+		}
+	}
+
+	references, err := api.sql.NamedQuery(queries["foreignKeys"], params)
+	if err != nil {
+		return nil, err
+	}
+	defer references.Close()
+	for references.Next() {
+		row := map[string]interface{}{}
+		if err := references.MapScan(row); err != nil {
+			return nil, err
+		}
+		for i := range tables {
+			if tables[i].name != formatValue(row["table_name"]) {
+				continue
+			}
+			for j := range tables[i].columns {
+				if tables[i].columns[j].name == formatValue(row["column_name"]) {
+					tables[i].columns[j].references = &columnReference{
+						Table:  formatValue(row["ref_table"]),
+						Column: formatValue(row["ref_column"]),
+					}
+				}
+			}
+		}
+	}
+	return tables, references.Err()
+}
+
+// GenerateSpec - a spec with CRUD operations for the tables and views of
+// schema, which GetServer can load
+func (api *API) GenerateSpec(schema string, maxLimit int) (*openapi3.Swagger, error) {
+	tables, err := api.introspect(schema)
+	if err != nil {
+		return nil, err
+	}
+	swagger := &openapi3.Swagger{
+		ExtensionProps: extensions(map[string]interface{}{"x-grest-strict-templates": true}),
+		OpenAPI:        "3.0.2",
+		Info:           &openapi3.Info{Title: "grest " + schema, Version: "1.0"},
+		Paths:          openapi3.Paths{},
+	}
+	dialect := catalogDialect(api.sql.DriverName())
+	for _, table := range tables {
+		addTable(swagger, table, dialect, "/"+table.name, table.name, maxLimit)
+	}
+	return swagger, nil
+}
+
+// grestAuto - x-grest-auto entry, CRUD operations for the tables of a
+// schema matching include but not exclude
+type grestAuto struct {
+	Schema string `json:"schema"`
+	// Include globs default to every table
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+	// Path prefixes the table paths, defaults to /<schema>
+	Path string `json:"path"`
+	// MaxLimit caps ?limit= of the list operations, defaults to 1000
+	MaxLimit int `json:"maxLimit"`
+}
+
+// matches - whether the globs select the table
+func (a grestAuto) matches(table string) bool {
+	included := len(a.Include) == 0
+	for _, glob := range a.Include {
+		if ok, _ := path.Match(glob, table); ok {
+			included = true
+		}
+	}
+	for _, glob := range a.Exclude {
+		if ok, _ := path.Match(glob, table); ok {
+			return false
+		}
+	}
+	return included
+}
+
+// addAuto - adds the generated operations of the x-grest-auto tables to the
+// spec, paths and components of the spec are kept
+func (api *API) addAuto(swagger *openapi3.Swagger, raw json.RawMessage) error {
+	entries := []grestAuto{}
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), "{") {
+		raw = json.RawMessage("[" + string(raw) + "]")
+	}
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return err
+	}
+
+	dialect := catalogDialect(api.sql.DriverName())
+	for _, entry := range entries {
+		if entry.Schema == "" {
+			return fmt.Errorf("every entry needs a schema")
+		}
+		if entry.MaxLimit < 0 {
+			return fmt.Errorf("maxLimit of %s must be positive", entry.Schema)
+		}
+		for _, glob := range append(entry.Include, entry.Exclude...) {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("bad glob %s : %s", glob, err)
+			}
+		}
+		prefix := strings.TrimSuffix(entry.Path, "/")
+		if entry.Path == "" {
+			prefix = "/" + entry.Schema
+		}
+
+		tables, err := api.introspect(entry.Schema)
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if !entry.matches(table.name) {
+				continue
+			}
+			component := entry.Schema + "." + table.name
+			if _, ok := swagger.Components.Schemas[component]; ok {
+				log.Println("Keeping the spec schema", component)
+				continue
+			}
+			addTable(swagger, table, dialect, prefix+"/"+table.name, component, entry.MaxLimit)
+		}
+	}
+	return nil
+}
+
+// extensions - extension values as GetServer finds them in a loaded spec
+func extensions(values map[string]interface{}) openapi3.ExtensionProps {
+	props := openapi3.ExtensionProps{Extensions: map[string]interface{}{}}
+	for key, value := range values {
+		raw, _ := json.Marshal(value)
+		props.Extensions[key] = json.RawMessage(raw)
+	}
+	return props
+}
+
+// columnSchema - the JSON schema of a native column type
+func columnSchema(native string) *openapi3.Schema {
+	typ := strings.ToLower(strings.TrimSpace(native))
+	if strings.HasSuffix(typ, "[]") {
+		return openapi3.NewArraySchema().WithItems(columnSchema(strings.TrimSuffix(typ, "[]")))
+	}
+	typ = strings.TrimSpace(strings.SplitN(typ, "(", 2)[0])
+	switch typ {
+	case "int", "int2", "int4", "integer", "smallint", "serial", "smallserial":
+		return openapi3.NewIntegerSchema()
+	case "int8", "bigint", "bigserial":
+		return openapi3.NewInt64Schema()
+	case "real", "float", "float4", "float8", "double", "double precision", "numeric", "decimal":
+		return openapi3.NewFloat64Schema()
+	case "bool", "boolean":
+		return openapi3.NewBoolSchema()
+	case "date":
+		return openapi3.NewStringSchema().WithFormat("date")
+	case "datetime", "timestamp", "timestamptz", "timestamp with time zone", "timestamp without time zone":
+		return openapi3.NewDateTimeSchema()
+	case "json", "jsonb":
+		return openapi3.NewSchema()
+	case "bytea", "blob":
+		return openapi3.NewBytesSchema()
+	case "uuid":
+		return openapi3.NewUUIDSchema()
+	}
+	return openapi3.NewStringSchema()
+}
+
+// tableSchema - the component schema of the rows of a table, properties
+// required by inserts are required
+func tableSchema(table tableInfo) *openapi3.Schema {
+	schema := openapi3.NewObjectSchema()
+	schema.Description = table.comment
+	for _, column := range table.columns {
+		property := columnSchema(column.typ)
+		property.Description = column.comment
+		property.Nullable = column.nullable
+		if column.references != nil {
+			property.ExtensionProps = extensions(map[string]interface{}{
+				"x-grest-references": column.references,
+			})
+		}
+		schema.WithProperty(column.name, property)
+		if !column.nullable && !column.hasDefault {
+			schema.Required = append(schema.Required, column.name)
+		}
+	}
+	return schema
+}
+
+// addTable - adds the component schema and operations of a table at route,
+// views are only listed and tables without a usable key have no row path.
+// Lists return at most maxLimit rows, or defaultMaxPageSize if it is 0.
+func addTable(
+	swagger *openapi3.Swagger, table tableInfo, dialect string, route string, component string, maxLimit int) {
+
+	if maxLimit == 0 {
+		maxLimit = defaultMaxPageSize
+	}
+	pageSize := defaultPageSize
+	if pageSize > maxLimit {
+		pageSize = maxLimit
+	}
+	quoting := dialectOf(dialect)
+	quoted := quoting.ident(table.schema) + "." + quoting.ident(table.name)
+	if !pathName.MatchString(table.name) {
+		log.Println("Skipping table that can't be a path", table.name)
+		return
+	}
+
+	schema := tableSchema(table)
+	if swagger.Components.Schemas == nil {
+		swagger.Components.Schemas = map[string]*openapi3.SchemaRef{}
+	}
+	ref := openapi3.NewSchemaRef("#/components/schemas/"+component, schema)
+	list := openapi3.NewArraySchema()
+	list.Items = ref
+	rows := openapi3.Responses{"200": &openapi3.ResponseRef{
+		Value: openapi3.NewResponse().WithDescription("OK").WithJSONSchema(list),
+	}}
+
+	returning := ""
+	if dialect == "postgres" {
+		returning = "\nRETURNING *"
+	}
+	// Reads pick columns and embed relations with ?select=
+	selects := map[string]string{"schema": table.schema, "table": table.name}
+	operation := func(summary string, sql string) *openapi3.Operation {
+		query := map[string]interface{}{"sql": sql}
+		if strings.HasPrefix(sql, "INSERT") {
+			// Inserts the body rows in batches under the params limit
+			query["batch"] = true
+		}
+		ext := map[string]interface{}{"queries": []map[string]interface{}{query}}
+		if strings.HasPrefix(sql, "SELECT") {
+			ext["select"] = selects
+		}
+		return &openapi3.Operation{
+			ExtensionProps: extensions(map[string]interface{}{
+				"x-grest": ext,
+				// The templates quote everything, whatever the spec says
+				"x-grest-strict-templates": true,
+			}),
+			Summary:     summary,
+			Description: table.comment,
+			Tags:        []string{component},
+			Responses:   rows,
+		}
+	}
+
+	order := "1"
+	keys, where := []string{}, []string{}
+	params := openapi3.NewParameters()
+	for _, key := range table.keys {
+		if !keyParam.MatchString(key) || reservedParams[key] {
+			log.Println("Skipping row operations of", table.name, "as key", key, "can't be a param")
+			keys, where, params = nil, nil, nil
+			break
+		}
+		keys = append(keys, quoting.ident(key))
+		// Keys are bound from the path params rather than inlined
+		where = append(where, fmt.Sprintf("%s = :%s", quoting.ident(key), key))
+		param := openapi3.NewPathParameter(key).WithSchema(openapi3.NewStringSchema())
+		params = append(params, &openapi3.ParameterRef{Value: param})
+	}
+	if len(keys) > 0 {
+		order = strings.Join(keys, ", ")
+	}
+	selectParam := &openapi3.ParameterRef{Value: openapi3.NewQueryParameter("select").WithSchema(
+		openapi3.NewStringSchema(),
+	).WithDescription("Columns and embedded relations, like *,lines(*),customer(name)")}
+
+	all := operation("List "+table.name, fmt.Sprintf(
+		"SELECT {{join \", \" ._select}} FROM %s\nORDER BY %s\n"+
+			"LIMIT %s(CAST(:limit AS integer), %d) OFFSET CAST(:offset AS integer)",
+		quoted, order, leastFunc[dialect], maxLimit,
+	))
+	all.Parameters = openapi3.Parameters{
+		{Value: openapi3.NewQueryParameter("limit").WithSchema(
+			openapi3.NewIntegerSchema().WithMin(0).WithMax(float64(maxLimit)).WithDefault(pageSize),
+		)},
+		{Value: openapi3.NewQueryParameter("offset").WithSchema(
+			openapi3.NewIntegerSchema().WithMin(0).WithDefault(0),
+		)},
+		selectParam,
+	}
+	item := &openapi3.PathItem{Get: all}
+	if !addPath(swagger, route, item) {
+		return
+	}
+	swagger.Components.Schemas[component] = openapi3.NewSchemaRef("", schema)
+	if table.view {
+		return
+	}
+
+	insert := operation("Insert "+table.name, fmt.Sprintf(
+		"INSERT INTO %s ({{columns .rows}})\n"+
+			"VALUES {{range $i, $row := .rows}}{{if $i}}, {{end}}"+
+			"({{placeholders $row (printf \"rows.%%d\" $i)}}){{end}}%s",
+		quoted, returning,
+	))
+	insert.RequestBody = &openapi3.RequestBodyRef{Value: bodyOf(ref, true)}
+	item.Post = insert
+
+	if len(keys) == 0 {
+		return
+	}
+	rowPath := route
+	for _, key := range table.keys {
+		rowPath += "/{" + key + "}"
+	}
+	filter := strings.Join(where, " AND ")
+
+	get := operation("Get "+table.name, fmt.Sprintf(
+		"SELECT {{join \", \" ._select}} FROM %s\nWHERE %s", quoted, filter,
+	))
+	get.Parameters = append(append(openapi3.Parameters{}, params...), selectParam)
+
+	update := operation("Update "+table.name, fmt.Sprintf(
+		"UPDATE %s SET {{assign (index .rows 0) \"rows.0\"}}\nWHERE %s%s", quoted, filter, returning,
+	))
+	update.Parameters = params
+	partial := *schema
+	partial.Required = nil
+	update.RequestBody = &openapi3.RequestBodyRef{Value: bodyOf(openapi3.NewSchemaRef("", &partial), true)}
+
+	remove := operation("Delete "+table.name, fmt.Sprintf(
+		"DELETE FROM %s\nWHERE %s%s", quoted, filter, returning,
+	))
+	remove.Parameters = params
+
+	addPath(swagger, rowPath, &openapi3.PathItem{Get: get, Patch: update, Delete: remove})
+}
+
+// addPath - adds a generated path unless the spec has it already
+func addPath(swagger *openapi3.Swagger, route string, item *openapi3.PathItem) bool {
+	if swagger.Paths[route] != nil {
+		log.Println("Keeping the spec operations of", route)
+		return false
+	}
+	swagger.Paths[route] = item
+	return true
+}
+
+// bodyOf - a JSON request body the templates may read
+func bodyOf(schema *openapi3.SchemaRef, required bool) *openapi3.RequestBody {
+	body := openapi3.NewRequestBody().WithRequired(required).WithJSONSchemaRef(schema)
+	body.ExtensionProps = extensions(map[string]interface{}{"x-grest-template-allowed": true})
+	return body
+}
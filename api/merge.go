@@ -0,0 +1,261 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// Extensions of spec files found in a directory
+var specExtensions = map[string]bool{".yml": true, ".yaml": true, ".json": true}
+
+// specFiles - the spec files of the paths, directories hold the spec files
+// directly inside them, in name order
+func specFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, entry := range entries {
+			if !entry.IsDir() && specExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+				files = append(files, filepath.Join(path, entry.Name()))
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No spec files in %s", path)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No spec files given")
+	}
+	return files, nil
+}
+
+// LoadSpec - loads the spec files (or directories of them) as one document.
+// Files may $ref each other, and the first file gives the info and servers.
+// Paths, their parameters, components and extensions are merged, failing
+// when two files define the same operation or give a name different
+// definitions.
+func LoadSpec(swaggerpaths ...string) (*openapi3.Swagger, error) {
+	files, err := specFiles(swaggerpaths)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &openapi3.Swagger{Paths: openapi3.Paths{}}
+	merged.Extensions = map[string]interface{}{}
+	merged.Components.Extensions = map[string]interface{}{}
+	m := merger{map[string]string{}}
+	for i, file := range files {
+		loader := openapi3.NewSwaggerLoader()
+		loader.IsExternalRefsAllowed = true
+		swagger, err := loader.LoadSwaggerFromFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load swagger %s : %s", file, err)
+		}
+		if i == 0 {
+			merged.OpenAPI, merged.Info, merged.Servers = swagger.OpenAPI, swagger.Info, swagger.Servers
+			merged.ExternalDocs = swagger.ExternalDocs
+		}
+		if err := m.merge(merged, swagger, file); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+// merger - remembers the file defining each operation and name
+type merger struct {
+	origins map[string]string
+}
+
+// claim - records that file defines key, failing when an earlier file
+// defined it differently
+func (m merger) claim(key string, file string, existing interface{}, defined bool, value interface{}) error {
+	if !defined {
+		m.origins[key] = file
+		return nil
+	}
+	if !sameJSON(existing, value) {
+		return fmt.Errorf("Spec files %s and %s both define %s", m.origins[key], file, key)
+	}
+	return nil
+}
+
+// merge - adds the paths, components and extensions of a file
+func (m merger) merge(into *openapi3.Swagger, from *openapi3.Swagger, file string) error {
+	for path, item := range from.Paths {
+		existing, ok := into.Paths[path]
+		if !ok {
+			existing = &openapi3.PathItem{}
+			into.Paths[path] = existing
+		}
+		if err := m.mergeParameters(path, existing, item.Parameters, file); err != nil {
+			return err
+		}
+		for method, op := range item.Operations() {
+			key := method + " " + path
+			if other, ok := m.origins[key]; ok {
+				return fmt.Errorf("Spec files %s and %s both define %s", other, file, key)
+			}
+			m.origins[key] = file
+			existing.SetOperation(method, op)
+		}
+	}
+
+	for kind, maps := range map[string][2]interface{}{
+		"schemas":         {&into.Components.Schemas, from.Components.Schemas},
+		"parameters":      {&into.Components.Parameters, from.Components.Parameters},
+		"headers":         {&into.Components.Headers, from.Components.Headers},
+		"requestBodies":   {&into.Components.RequestBodies, from.Components.RequestBodies},
+		"responses":       {&into.Components.Responses, from.Components.Responses},
+		"securitySchemes": {&into.Components.SecuritySchemes, from.Components.SecuritySchemes},
+		"examples":        {&into.Components.Examples, from.Components.Examples},
+		"links":           {&into.Components.Links, from.Components.Links},
+		"callbacks":       {&into.Components.Callbacks, from.Components.Callbacks},
+	} {
+		if err := m.mergeComponents("#/components/"+kind+"/", maps[0], maps[1], file); err != nil {
+			return err
+		}
+	}
+
+	// Templates are named like components, other extensions must agree
+	for name, value := range from.Components.Extensions {
+		if name == "x-grest-templates" {
+			if err := m.mergeTemplates(into, rawExtension(value), file); err != nil {
+				return err
+			}
+			continue
+		}
+		existing, ok := into.Components.Extensions[name]
+		if err := m.claim("components "+name, file, existing, ok, value); err != nil {
+			return err
+		}
+		into.Components.Extensions[name] = value
+	}
+	for name, value := range from.Extensions {
+		existing, ok := into.Extensions[name]
+		if err := m.claim(name, file, existing, ok, value); err != nil {
+			return err
+		}
+		into.Extensions[name] = value
+	}
+
+	for _, req := range from.Security {
+		found := false
+		for _, existing := range into.Security {
+			found = found || sameJSON(existing, req)
+		}
+		if !found {
+			into.Security = append(into.Security, req)
+		}
+	}
+	for _, tag := range from.Tags {
+		if into.Tags.Get(tag.Name) == nil {
+			into.Tags = append(into.Tags, tag)
+		}
+	}
+	return nil
+}
+
+// mergeParameters - adds the path level parameters of a file, which apply
+// to the operations of every file, failing when an earlier file defined a
+// parameter of the same name and location differently
+func (m merger) mergeParameters(path string, into *openapi3.PathItem, from openapi3.Parameters, file string) error {
+	for _, param := range from {
+		key := fmt.Sprintf("%s parameter %s in %s", path, param.Value.Name, param.Value.In)
+		existing := into.Parameters.GetByInAndName(param.Value.In, param.Value.Name)
+		if err := m.claim(key, file, existing, existing != nil, param.Value); err != nil {
+			return err
+		}
+		if existing == nil {
+			into.Parameters = append(into.Parameters, param)
+		}
+	}
+	return nil
+}
+
+// mergeComponents - adds the components of from, a map of refs, to the map
+// into points at
+func (m merger) mergeComponents(prefix string, into interface{}, from interface{}, file string) error {
+	target, source := reflect.ValueOf(into).Elem(), reflect.ValueOf(from)
+	if source.Len() == 0 {
+		return nil
+	}
+	if target.IsNil() {
+		target.Set(reflect.MakeMap(target.Type()))
+	}
+	names := []string{}
+	for _, key := range source.MapKeys() {
+		names = append(names, key.String())
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := reflect.ValueOf(name)
+		var existing interface{}
+		current := target.MapIndex(key)
+		if current.IsValid() {
+			existing = current.Interface()
+		}
+		if err := m.claim(prefix+name, file, existing, current.IsValid(), source.MapIndex(key).Interface()); err != nil {
+			return err
+		}
+		target.SetMapIndex(key, source.MapIndex(key))
+	}
+	return nil
+}
+
+// mergeTemplates - adds the named templates and query lists of a file to
+// components x-grest-templates
+func (m merger) mergeTemplates(into *openapi3.Swagger, raw json.RawMessage, file string) error {
+	templates := map[string]json.RawMessage{}
+	if existing := rawExtension(into.Components.Extensions["x-grest-templates"]); existing != nil {
+		if err := json.Unmarshal(existing, &templates); err != nil {
+			return err
+		}
+	}
+	added := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &added); err != nil {
+		return fmt.Errorf("Failed to parse components x-grest-templates of %s : %s", file, err)
+	}
+	for name, value := range added {
+		existing, ok := templates[name]
+		if err := m.claim(templatesRef+name, file, existing, ok, value); err != nil {
+			return err
+		}
+		templates[name] = value
+	}
+	encoded, err := json.Marshal(templates)
+	if err != nil {
+		return err
+	}
+	into.Components.Extensions["x-grest-templates"] = json.RawMessage(encoded)
+	return nil
+}
+
+// sameJSON - whether two values marshal to the same JSON
+func sameJSON(a interface{}, b interface{}) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
@@ -0,0 +1,384 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Key of the Postgres advisory lock held while migrating, so concurrent
+// runs (like several replicas starting at once) apply each file once
+const migrationLock = 4758143202
+
+// Tracking table of the applied migrations, created by the first run
+var migrationTables = map[string]string{
+	"postgres": `CREATE TABLE IF NOT EXISTS grest_migrations (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		checksum text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	"sqlite3": `CREATE TABLE IF NOT EXISTS grest_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+}
+
+// Whether the tracking table exists, so reading the status creates nothing
+var migrationTableExists = map[string]string{
+	"postgres": `SELECT count(*) AS found FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name = 'grest_migrations'`,
+	"sqlite3": `SELECT count(*) AS found FROM sqlite_master
+		WHERE type = 'table' AND name = 'grest_migrations'`,
+}
+
+// Migration files look like 20201224150405_create_orders.up.sql, with the
+// matching .down.sql undoing them
+var migrationFile = regexp.MustCompile(`^([0-9]+)_([A-Za-z0-9_]+)\.(up|down)\.sql$`)
+
+var migrationName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// Migration - a versioned pair of SQL files
+type Migration struct {
+	Version int64
+	Name    string
+	// Up and Down are the statements of the files, Down is empty without
+	// a .down.sql file
+	Up   string
+	Down string
+	// HasDown is set when the .down.sql file exists
+	HasDown bool
+	// Checksum is the sha256 of Up, so edits to applied files are noticed
+	Checksum string
+}
+
+// MigrationStatus - a migration and whether it was applied
+type MigrationStatus struct {
+	Version int64
+	Name    string
+	// State is applied, pending, changed (applied before its file was
+	// edited) or missing (applied but its file is gone)
+	State     string
+	AppliedAt string
+}
+
+// LoadMigrations - the migrations of a directory, ordered by version
+func LoadMigrations(dir string) ([]Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, file := range files {
+		match := migrationFile.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %s", file.Name(), err)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", m.Name, match[2], version)
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+			sum := sha256.Sum256(content)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(content)
+			m.HasDown = true
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.Checksum == "" {
+			return nil, fmt.Errorf("migration %d_%s has no .up.sql file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// CreateMigration - writes empty up and down files for a new migration,
+// versioned by the current time, returning their paths
+func CreateMigration(dir string, name string) ([]string, error) {
+	if !migrationName.MatchString(name) {
+		return nil, fmt.Errorf("migration name %s must only use letters, digits and _", name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	version := time.Now().UTC().Format("20060102150405")
+	paths := []string{}
+	for _, direction := range []string{"up", "down"} {
+		path := filepath.Join(dir, fmt.Sprintf("%s_%s.%s.sql", version, name, direction))
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return paths, err
+		}
+		fmt.Fprintf(file, "-- %s %s\n", name, direction)
+		if err := file.Close(); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// appliedMigration - a row of grest_migrations
+type appliedMigration struct {
+	name      string
+	checksum  string
+	appliedAt string
+}
+
+// lockMigrations - takes the migration lock for the transaction and makes
+// sure the tracking table exists, returning the applied migrations.
+// SQLite needs no lock as it allows a single writer anyway.
+func (api *API) lockMigrations(txn txInterface) (map[int64]appliedMigration, error) {
+	dialect := catalogDialect(api.sql.DriverName())
+	if dialect == "postgres" {
+		_, err := txn.NamedExec("SELECT pg_advisory_xact_lock(:key)", map[string]interface{}{"key": migrationLock})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := txn.Exec(migrationTables[dialect]); err != nil {
+		return nil, err
+	}
+	return readMigrations(txn)
+}
+
+// readMigrations - the rows of grest_migrations
+func readMigrations(txn txInterface) (map[int64]appliedMigration, error) {
+	rows, err := txn.NamedQuery(
+		"SELECT version, name, checksum, CAST(applied_at AS text) AS applied_at FROM grest_migrations",
+		map[string]interface{}{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]appliedMigration{}
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			return nil, err
+		}
+		version, err := strconv.ParseInt(formatValue(row["version"]), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedMigration{
+			formatValue(row["name"]), formatValue(row["checksum"]), formatValue(row["applied_at"]),
+		}
+	}
+	return applied, rows.Err()
+}
+
+// appliedMigrations - the applied migrations without taking the lock, none
+// when nothing was migrated yet
+func (api *API) appliedMigrations(txn txInterface) (map[int64]appliedMigration, error) {
+	rows, err := txn.NamedQuery(migrationTableExists[catalogDialect(api.sql.DriverName())], map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		found = formatValue(row["found"]) != "0"
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || !found {
+		return map[int64]appliedMigration{}, err
+	}
+	return readMigrations(txn)
+}
+
+// checkApplied - fails when applied migrations were edited or removed, as
+// the database no longer matches the files
+func checkApplied(migrations []Migration, applied map[int64]appliedMigration) error {
+	files := map[int64]Migration{}
+	for _, m := range migrations {
+		files[m.Version] = m
+		if row, ok := applied[m.Version]; ok && row.checksum != m.Checksum {
+			return fmt.Errorf("migration %d_%s was changed after it was applied", m.Version, m.Name)
+		}
+	}
+	for version, row := range applied {
+		if _, ok := files[version]; !ok {
+			return fmt.Errorf("applied migration %d_%s is missing", version, row.name)
+		}
+	}
+	return nil
+}
+
+// migrateStep - applies (or reverts) a single migration in its own
+// transaction. next picks it once the lock is held, nil when done.
+func (api *API) migrateStep(
+	migrations []Migration, next func(map[int64]appliedMigration) (*Migration, bool, error)) (*Migration, error) {
+
+	txn, err := api.sql.BeginWrite()
+	if err != nil {
+		return nil, err
+	}
+	// Commit releases the connection too, so only roll back before it
+	rollback := func(err error) (*Migration, error) {
+		txn.Rollback()
+		return nil, err
+	}
+
+	applied, err := api.lockMigrations(txn)
+	if err != nil {
+		return rollback(err)
+	}
+	if err := checkApplied(migrations, applied); err != nil {
+		return rollback(err)
+	}
+	m, up, err := next(applied)
+	if err != nil || m == nil {
+		return rollback(err)
+	}
+
+	statements, record := m.Up, "INSERT INTO grest_migrations (version, name, checksum) VALUES (:version, :name, :checksum)"
+	if !up {
+		statements, record = m.Down, "DELETE FROM grest_migrations WHERE version = :version"
+	}
+	if strings.TrimSpace(statements) != "" {
+		if _, err := txn.Exec(statements); err != nil {
+			return rollback(fmt.Errorf("migration %d_%s: %s", m.Version, m.Name, err))
+		}
+	}
+	_, err = txn.NamedExec(record, map[string]interface{}{
+		"version": m.Version, "name": m.Name, "checksum": m.Checksum,
+	})
+	if err != nil {
+		return rollback(err)
+	}
+	if err := txn.Commit(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Migrate - applies the pending migrations of a directory in order, each in
+// its own transaction, returning the ones applied. Call it before GetServer
+// so the routes see the migrated schema.
+func (api *API) Migrate(dir string) ([]Migration, error) {
+	migrations, err := LoadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+	done := []Migration{}
+	for {
+		m, err := api.migrateStep(migrations, func(applied map[int64]appliedMigration) (*Migration, bool, error) {
+			for i := range migrations {
+				if _, ok := applied[migrations[i].Version]; !ok {
+					return &migrations[i], true, nil
+				}
+			}
+			return nil, true, nil
+		})
+		if err != nil || m == nil {
+			return done, err
+		}
+		done = append(done, *m)
+	}
+}
+
+// MigrateDown - reverts the last applied migrations, newest first,
+// returning the ones reverted
+func (api *API) MigrateDown(dir string, steps int) ([]Migration, error) {
+	migrations, err := LoadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+	done := []Migration{}
+	for len(done) < steps {
+		m, err := api.migrateStep(migrations, func(applied map[int64]appliedMigration) (*Migration, bool, error) {
+			for i := len(migrations) - 1; i >= 0; i-- {
+				if _, ok := applied[migrations[i].Version]; !ok {
+					continue
+				}
+				if !migrations[i].HasDown {
+					return nil, false, fmt.Errorf(
+						"migration %d_%s has no .down.sql file", migrations[i].Version, migrations[i].Name,
+					)
+				}
+				return &migrations[i], false, nil
+			}
+			return nil, false, nil
+		})
+		if err != nil || m == nil {
+			return done, err
+		}
+		done = append(done, *m)
+	}
+	return done, nil
+}
+
+// MigrationStatus - the state of every migration of the directory, and of
+// applied migrations whose files are missing. It only reads, so neither
+// waits for a running migration nor creates the tracking table.
+func (api *API) MigrationStatus(dir string) ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	txn, err := api.sql.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := api.appliedMigrations(txn)
+	txn.Rollback()
+	if err != nil {
+		return nil, err
+	}
+
+	status := []MigrationStatus{}
+	for _, m := range migrations {
+		s := MigrationStatus{Version: m.Version, Name: m.Name, State: "pending"}
+		if row, ok := applied[m.Version]; ok {
+			s.State, s.AppliedAt = "applied", row.appliedAt
+			if row.checksum != m.Checksum {
+				s.State = "changed"
+			}
+			delete(applied, m.Version)
+		}
+		status = append(status, s)
+	}
+	for version, row := range applied {
+		status = append(status, MigrationStatus{version, row.name, "missing", row.appliedAt})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+	return status, nil
+}
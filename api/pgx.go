@@ -0,0 +1,229 @@
+package api
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/jackc/pgx/stdlib"
+	"github.com/jmoiron/sqlx"
+)
+
+// Native pgx transaction so that the copy protocol shares the transaction
+// (and role) with the named queries
+type pgxTxBackend struct {
+	db   *sqlx.DB
+	conn *pgx.Conn
+	txn  *pgx.Tx
+}
+
+type pgxRows struct {
+	rows   *pgx.Rows
+	values []interface{}
+}
+
+type pgxResult struct {
+	tag pgx.CommandTag
+}
+
+func beginPgx(db *sqlx.DB) (txInterface, error) {
+	conn, err := stdlib.AcquireConn(db.DB)
+	if err != nil {
+		return nil, err
+	}
+	txn, err := conn.Begin()
+	if err != nil {
+		stdlib.ReleaseConn(db.DB, conn)
+		return nil, err
+	}
+	return pgxTxBackend{db, conn, txn}, nil
+}
+
+// compileNamed - converts :name parameters into pgx $1 placeholders
+func compileNamed(query string, arg interface{}) (string, []interface{}, error) {
+	query, args, err := sqlx.Named(query, arg)
+	if err != nil {
+		return "", nil, err
+	}
+	return sqlx.Rebind(sqlx.DOLLAR, query), args, nil
+}
+
+func (txn pgxTxBackend) NamedQuery(query string, arg interface{}) (rowsInterface, error) {
+	query, args, err := compileNamed(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := txn.txn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &pgxRows{rows: rows}, nil
+}
+
+func (txn pgxTxBackend) NamedExec(query string, arg interface{}) (sql.Result, error) {
+	query, args, err := compileNamed(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := txn.txn.Exec(query, args...)
+	return pgxResult{tag}, err
+}
+
+func (txn pgxTxBackend) Exec(query string) (sql.Result, error) {
+	// Without arguments pgx uses the simple protocol, so several
+	// statements may run at once
+	tag, err := txn.txn.Exec(query)
+	return pgxResult{tag}, err
+}
+
+func (txn pgxTxBackend) CopyFrom(r io.Reader, table []string, columns []string) (int64, error) {
+	tag, err := txn.txn.CopyFromReader(r, copyFromSQL(table, columns)+" WITH (FORMAT csv)")
+	if err != nil {
+		if pgerr, ok := err.(pgx.PgError); ok {
+			return 0, copyError{copyLine(pgerr.Where), err}
+		}
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (txn pgxTxBackend) CopyTo(w io.Writer, query string, arg interface{}, format string) (int64, error) {
+	query, err := inlineParams(query, arg)
+	if err != nil {
+		return 0, err
+	}
+	options := "FORMAT binary"
+	if format == "csv" {
+		options = "FORMAT csv, HEADER"
+	}
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	tag, err := txn.txn.CopyToWriter(w, "COPY ("+query+") TO STDOUT WITH ("+options+")")
+	return tag.RowsAffected(), err
+}
+
+func (txn pgxTxBackend) LargeObject(r io.Reader) (uint32, error) {
+	objects, err := txn.txn.LargeObjects()
+	if err != nil {
+		return 0, err
+	}
+	oid, err := objects.Create(0)
+	if err != nil {
+		return 0, err
+	}
+	object, err := objects.Open(oid, pgx.LargeObjectModeWrite)
+	if err != nil {
+		return 0, err
+	}
+	defer object.Close()
+	_, err = io.Copy(object, r)
+	return uint32(oid), err
+}
+
+func (txn pgxTxBackend) OpenLargeObject(oid uint32) (io.ReadSeeker, error) {
+	objects, err := txn.txn.LargeObjects()
+	if err != nil {
+		return nil, err
+	}
+	// Closed with the transaction
+	return objects.Open(pgtype.OID(oid), pgx.LargeObjectModeRead)
+}
+
+func (txn pgxTxBackend) Rollback() error {
+	defer stdlib.ReleaseConn(txn.db.DB, txn.conn)
+	return txn.txn.Rollback()
+}
+
+func (txn pgxTxBackend) Commit() error {
+	defer stdlib.ReleaseConn(txn.db.DB, txn.conn)
+	return txn.txn.Commit()
+}
+
+func (result pgxResult) LastInsertId() (int64, error) {
+	return 0, errors.New("LastInsertId is not supported by pgx")
+}
+
+func (result pgxResult) RowsAffected() (int64, error) {
+	return result.tag.RowsAffected(), nil
+}
+
+func (rows *pgxRows) Next() bool {
+	return rows.rows.Next()
+}
+
+func (rows *pgxRows) Close() error {
+	rows.rows.Close()
+	return nil
+}
+
+func (rows *pgxRows) Err() error {
+	return rows.rows.Err()
+}
+
+func (rows *pgxRows) Columns() ([]string, error) {
+	fields := rows.rows.FieldDescriptions()
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		columns[i] = field.Name
+	}
+	return columns, nil
+}
+
+func (rows *pgxRows) Scan(dest ...interface{}) error {
+	return rows.rows.Scan(dest...)
+}
+
+// MapScan - scans using the same types as the pgx database/sql driver
+func (rows *pgxRows) MapScan(dest map[string]interface{}) error {
+	fields := rows.rows.FieldDescriptions()
+	if rows.values == nil {
+		rows.values = make([]interface{}, len(fields))
+		for i, field := range fields {
+			switch field.DataType {
+			case pgtype.BoolOID:
+				rows.values[i] = &pgtype.Bool{}
+			case pgtype.ByteaOID:
+				rows.values[i] = &pgtype.Bytea{}
+			case pgtype.DateOID:
+				rows.values[i] = &pgtype.Date{}
+			case pgtype.Float4OID:
+				rows.values[i] = &pgtype.Float4{}
+			case pgtype.Float8OID:
+				rows.values[i] = &pgtype.Float8{}
+			case pgtype.Int2OID:
+				rows.values[i] = &pgtype.Int2{}
+			case pgtype.Int4OID:
+				rows.values[i] = &pgtype.Int4{}
+			case pgtype.Int8OID:
+				rows.values[i] = &pgtype.Int8{}
+			case pgtype.JSONOID:
+				rows.values[i] = &pgtype.JSON{}
+			case pgtype.JSONBOID:
+				rows.values[i] = &pgtype.JSONB{}
+			case pgtype.OIDOID:
+				rows.values[i] = &pgtype.OIDValue{}
+			case pgtype.TimestampOID:
+				rows.values[i] = &pgtype.Timestamp{}
+			case pgtype.TimestamptzOID:
+				rows.values[i] = &pgtype.Timestamptz{}
+			default:
+				rows.values[i] = &pgtype.GenericText{}
+			}
+		}
+	}
+
+	if err := rows.rows.Scan(rows.values...); err != nil {
+		return err
+	}
+	for i, field := range fields {
+		value, err := rows.values[i].(driver.Valuer).Value()
+		if err != nil {
+			return err
+		}
+		dest[field.Name] = value
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// grestRaw - x-grest raw, serves a column of the first row as the body
+type grestRaw struct {
+	// Column holds the bytes, or the oid of a large object
+	Column string `json:"column"`
+	// ContentType names the column with the media type, if any
+	ContentType string `json:"contentType"`
+	// Filename names the column with the attachment filename, if any
+	Filename string `json:"filename"`
+	// LargeObject streams Column as a Postgres large object oid
+	LargeObject bool `json:"largeObject"`
+	// ETag names the column with the ETag, like the :file.sha256 of the
+	// upload. Bytes are hashed without it, large objects have no ETag as
+	// hashing them would read them twice
+	ETag string `json:"etag"`
+}
+
+func (r *grestRaw) compile(name string) (*grestRaw, error) {
+	if r.Column == "" {
+		return nil, fmt.Errorf("Extension x-grest raw requires a column at %s", name)
+	}
+	return r, nil
+}
+
+// endTxnEncoder - encoders that still need the transaction when ending
+type endTxnEncoder interface {
+	encoder
+	EndTxn(txn txInterface) error
+}
+
+// rawResponse - writes the raw column of the first row with http.ServeContent
+// so that Range, If-Range and If-None-Match are handled
+type rawResponse struct {
+	settings *grestRaw
+	c        echo.Context
+	row      map[string]interface{}
+}
+
+func newRawResponse(c echo.Context, settings *grestRaw) *rawResponse {
+	return &rawResponse{settings: settings, c: c}
+}
+
+func (r *rawResponse) Begin(columns []string) error {
+	return nil
+}
+
+func (r *rawResponse) Encode(row map[string]interface{}) error {
+	if r.row == nil {
+		r.row = row
+	}
+	return nil
+}
+
+func (r *rawResponse) End() error {
+	return r.EndTxn(nil)
+}
+
+func (r *rawResponse) EndTxn(txn txInterface) error {
+	if r.row == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "No content found")
+	}
+	value, ok := r.row[r.settings.Column]
+	if !ok {
+		return echo.NewHTTPError(
+			http.StatusInternalServerError,
+			fmt.Sprintf("Column %s is missing from the result", r.settings.Column),
+		)
+	}
+	if value == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "No content found")
+	}
+
+	header := r.c.Response().Header()
+	contentType := echo.MIMEOctetStream
+	if name := formatValue(r.row[r.settings.ContentType]); r.settings.ContentType != "" && name != "" {
+		contentType = name
+	}
+	header.Set(echo.HeaderContentType, contentType)
+	filename := ""
+	if r.settings.Filename != "" {
+		filename = formatValue(r.row[r.settings.Filename])
+	}
+	if filename != "" {
+		header.Set(echo.HeaderContentDisposition, mime.FormatMediaType(
+			"attachment", map[string]string{"filename": filename},
+		))
+	}
+
+	var content io.ReadSeeker
+	if r.settings.LargeObject {
+		oid, err := strconv.ParseUint(formatValue(value), 10, 32)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Large object oid expected")
+		}
+		if txn == nil {
+			return errLargeObject
+		}
+		object, err := txn.OpenLargeObject(uint32(oid))
+		if err == errLargeObject {
+			return echo.NewHTTPError(http.StatusNotImplemented, err.Error())
+		} else if err != nil {
+			log.Println("Failed to open large object", err)
+			return errorMapping(err)
+		}
+		content = object
+	} else {
+		var data []byte
+		switch value.(type) {
+		case []byte:
+			data = value.([]byte)
+		default:
+			data = []byte(formatValue(value))
+		}
+		if r.settings.ETag == "" {
+			sum := sha256.Sum256(data)
+			header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		}
+		content = bytes.NewReader(data)
+	}
+	if r.settings.ETag != "" {
+		if etag := formatValue(r.row[r.settings.ETag]); etag != "" {
+			header.Set("ETag", `"`+etag+`"`)
+		}
+	}
+
+	http.ServeContent(r.c.Response(), r.c.Request(), filename, time.Time{}, content)
+	return nil
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Reloader - serves the routes of a spec, swapping in a new router when the
+// spec is reloaded. Requests already routed finish on the old routes, and
+// an invalid spec leaves the old routes serving.
+type Reloader struct {
+	api       *API
+	paths     []string
+	adminPath string
+	// admins are the users allowed to POST to adminPath
+	admins map[string]bool
+	router atomic.Value
+	// mutex allows one reload at a time
+	mutex sync.Mutex
+	// loaded describes the spec files last loaded
+	loaded string
+}
+
+// NewReloader - loads the spec files, failing like LoadServer. When
+// adminPath is set, POST to it reloads the spec, behind its security and
+// only for the admins (anon when the spec has no security).
+func (api *API) NewReloader(adminPath string, admins []string, swaggerpaths ...string) (*Reloader, error) {
+	r := &Reloader{api: api, paths: swaggerpaths, adminPath: adminPath, admins: map[string]bool{}}
+	for _, admin := range admins {
+		r.admins[admin] = true
+	}
+	if adminPath != "" && len(admins) == 0 {
+		return nil, fmt.Errorf("Reload path %s needs the users allowed to reload", adminPath)
+	}
+	return r, r.Reload()
+}
+
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.router.Load().(*echo.Echo).ServeHTTP(w, req)
+}
+
+// Reload - loads the spec again, keeping the old routes if it is invalid
+func (r *Reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Noted before loading, so edits made while loading are seen by Watch
+	r.loaded = specVersion(r.paths)
+	e, err := r.api.LoadServer(r.paths...)
+	if err != nil {
+		return err
+	}
+	if r.adminPath != "" {
+		e.POST(r.adminPath, r.reloadHandler)
+	}
+	r.router.Store(e)
+	return nil
+}
+
+// reloadHandler - the admin endpoint, 422 with the reason when the spec
+// is invalid
+func (r *Reloader) reloadHandler(c echo.Context) error {
+	username, ok := c.Get("username").(string)
+	if !ok {
+		username = "anon"
+	}
+	if !r.admins[username] {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins may reload the spec")
+	}
+	if err := r.Reload(); err != nil {
+		log.Println("Failed to reload", r.paths, err)
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	}
+	log.Println("Reloaded", r.paths)
+	return c.JSON(http.StatusOK, map[string][]string{"reloaded": r.paths})
+}
+
+// specVersion - the names, times and sizes of the spec files, which change
+// when files are edited, added or removed
+func specVersion(paths []string) string {
+	files, err := specFiles(paths)
+	if err != nil {
+		// Likely replaced by an editor, seen once it is back
+		return ""
+	}
+	version := []string{}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return ""
+		}
+		version = append(version, fmt.Sprintf("%s %d %d", file, info.ModTime().UnixNano(), info.Size()))
+	}
+	return strings.Join(version, "\n")
+}
+
+// changed - whether the spec files differ from the ones last loaded
+func (r *Reloader) changed() bool {
+	version := specVersion(r.paths)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return version != "" && version != r.loaded
+}
+
+// Watch - polls the spec files every interval, reloading them when changed,
+// until stop is closed
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.Println("Failed to reload", r.paths, err)
+			} else {
+				log.Println("Reloaded", r.paths)
+			}
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Path of the built-in endpoint enabled by x-grest-rpc on the spec
+const rpcPath = "/_rpc/:function"
+
+// Input arguments of the functions with a name, in order, as seen by the
+// current role. Functions returning sets, composite types or OUT params
+// return rows, others a single value. WITH ORDINALITY needs PostgreSQL 9.4
+// or later, the %s leaves out other kinds of pg_proc, see rpcKinds.
+const rpcQuery = `SELECT CAST(p.oid AS bigint) AS oid,
+		p.proretset OR t.typtype = 'c' OR p.proallargtypes IS NOT NULL AS returns_rows,
+		p.pronargs AS nargs, p.pronargdefaults AS ndefaults,
+		has_function_privilege(p.oid, 'EXECUTE') AS executable,
+		COALESCE(a.name, '') AS arg_name,
+		COALESCE(format_type(a.type, NULL), '') AS arg_type,
+		CAST(COALESCE(a.mode, 'i') AS text) AS arg_mode
+	FROM pg_catalog.pg_proc AS p
+	JOIN pg_catalog.pg_namespace AS n ON n.oid = p.pronamespace
+	JOIN pg_catalog.pg_type AS t ON t.oid = p.prorettype
+	LEFT JOIN LATERAL unnest(
+		COALESCE(p.proallargtypes, CAST(p.proargtypes AS oid[])), p.proargnames, p.proargmodes
+	) WITH ORDINALITY AS a(type, name, mode, position)
+		ON a.mode IS NULL OR a.mode IN ('i', 'b', 'v')
+	WHERE n.nspname = :schema AND p.proname = :name AND %s
+	ORDER BY p.oid, a.position`
+
+// rpcKinds - plain functions only, without aggregates, window functions
+// and procedures, which prokind tells apart from PostgreSQL 11 and flags
+// before
+func rpcKinds(version int64) string {
+	if version >= 110000 {
+		return "p.prokind = 'f'"
+	}
+	return "NOT p.proisagg AND NOT p.proiswindow"
+}
+
+// grestRPC - x-grest-rpc, calls a stored function with the body and params
+// as named arguments. On the spec it enables POST /_rpc/{function}.
+type grestRPC struct {
+	// Function is the function called by an operation, maybe schema qualified
+	Function string `json:"function"`
+	// Schema holds unqualified functions, defaults to public
+	Schema string `json:"schema"`
+	// param is the path param naming the function, for /_rpc/{function}
+	param string
+}
+
+func (r *grestRPC) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &r.Function); err == nil {
+		return nil
+	}
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		return nil
+	}
+	type plain grestRPC
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+func (r *grestRPC) compile(name string, dialect string) (*grestRPC, error) {
+	if dialect != "postgres" {
+		return nil, fmt.Errorf("Extension x-grest-rpc requires Postgres at %s", name)
+	}
+	if r.Function == "" && r.param == "" {
+		return nil, fmt.Errorf("Extension x-grest-rpc requires a function at %s", name)
+	}
+	if r.Schema == "" {
+		r.Schema = "public"
+	}
+	return r, nil
+}
+
+// target - the schema and name of the function to call. Functions named by
+// the path are always in the configured schema, so callers can't reach
+// other schemas (like pg_catalog) through it.
+func (r *grestRPC) target(params map[string]interface{}) (string, string, error) {
+	if r.param != "" {
+		function := formatValue(params[r.param])
+		if strings.Contains(function, ".") {
+			return "", "", echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("No function %s in schema %s", function, r.Schema))
+		}
+		return r.Schema, function, nil
+	}
+	if parts := strings.SplitN(r.Function, ".", 2); len(parts) == 2 {
+		return parts[0], parts[1], nil
+	}
+	return r.Schema, r.Function, nil
+}
+
+// args - the body keys and non empty params (besides the function name),
+// params take precedence as they are declared by the spec
+func (r *grestRPC) args(body interface{}, params map[string]interface{}) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	switch body.(type) {
+	case map[string]interface{}:
+		for key, value := range body.(map[string]interface{}) {
+			args[key] = value
+		}
+	default:
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Function arguments must be an object")
+	}
+	for key, value := range params {
+		if key != r.param && formatValue(value) != "" {
+			args[key] = value
+		}
+	}
+	return args, nil
+}
+
+// rpcFunction - an overload of a stored function
+type rpcFunction struct {
+	schema string
+	name   string
+	args   []rpcArg
+	// required is the number of leading args without a default
+	required    int
+	returnsRows bool
+	executable  bool
+}
+
+type rpcArg struct {
+	name     string
+	typ      string
+	variadic bool
+}
+
+// loadFunctions - the overloads of a function, loaded after the role was set
+func loadFunctions(txn txInterface, schema string, name string) ([]rpcFunction, error) {
+	version, err := queryInt(
+		txn, "SELECT CAST(current_setting('server_version_num') AS integer) AS version",
+		map[string]interface{}{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := txn.NamedQuery(
+		fmt.Sprintf(rpcQuery, rpcKinds(version)), map[string]interface{}{"schema": schema, "name": name},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	functions := []rpcFunction{}
+	last := ""
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			return nil, err
+		}
+		if oid := formatValue(row["oid"]); oid != last {
+			last = oid
+			nargs, ndefaults := 0, 0
+			fmt.Sscan(formatValue(row["nargs"]), &nargs)
+			fmt.Sscan(formatValue(row["ndefaults"]), &ndefaults)
+			functions = append(functions, rpcFunction{
+				schema:      schema,
+				name:        name,
+				required:    nargs - ndefaults,
+				returnsRows: row["returns_rows"] == true,
+				executable:  row["executable"] == true,
+			})
+		}
+		if typ := formatValue(row["arg_type"]); typ != "" {
+			fn := &functions[len(functions)-1]
+			fn.args = append(fn.args, rpcArg{
+				name:     formatValue(row["arg_name"]),
+				typ:      typ,
+				variadic: formatValue(row["arg_mode"]) == "v",
+			})
+		}
+	}
+	return functions, rows.Err()
+}
+
+// accepts - nil if the args name the arguments of the function
+func (fn rpcFunction) accepts(args map[string]interface{}) error {
+	known := map[string]bool{}
+	for i, arg := range fn.args {
+		if arg.name != "" {
+			known[arg.name] = true
+		}
+		if _, ok := args[arg.name]; i < fn.required && (arg.name == "" || !ok) {
+			return fmt.Errorf("missing argument %s of %s.%s", arg.name, fn.schema, fn.name)
+		}
+	}
+	keys := []string{}
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !known[key] {
+			return fmt.Errorf("%s.%s has no argument %s", fn.schema, fn.name, key)
+		}
+	}
+	return nil
+}
+
+// call - the SQL calling the function with named arguments cast to their
+// types, bound as :arg_0, :arg_1 ...
+func (fn rpcFunction) call(args map[string]interface{}) (string, map[string]interface{}) {
+	quoting := dialectOf("postgres")
+	params := map[string]interface{}{}
+	named := []string{}
+	for _, arg := range fn.args {
+		value, ok := args[arg.name]
+		if !ok {
+			continue
+		}
+		param := fmt.Sprintf("arg_%d", len(named))
+		params[param] = paramValue(value, "postgres")
+		sql := fmt.Sprintf("%s => CAST(:%s AS %s)", quoting.ident(arg.name), param, arg.typ)
+		if arg.variadic {
+			sql = "VARIADIC " + sql
+		}
+		named = append(named, sql)
+	}
+	call := fmt.Sprintf(
+		"%s.%s(%s)", quoting.ident(fn.schema), quoting.ident(fn.name), strings.Join(named, ", "),
+	)
+	if fn.returnsRows {
+		return "SELECT * FROM " + call, params
+	}
+	return "SELECT " + call + " AS " + quoting.ident(fn.name), params
+}
+
+// pickFunction - the overload accepting the args, 404 without any and 403
+// when the role can't execute it
+func pickFunction(functions []rpcFunction, schema string, name string, args map[string]interface{}) (rpcFunction, error) {
+	if len(functions) == 0 {
+		return rpcFunction{}, echo.NewHTTPError(
+			http.StatusNotFound, fmt.Sprintf("Unknown function %s.%s", schema, name),
+		)
+	}
+	var mismatch error
+	forbidden := false
+	for _, fn := range functions {
+		if err := fn.accepts(args); err != nil {
+			mismatch = err
+		} else if !fn.executable {
+			forbidden = true
+		} else {
+			return fn, nil
+		}
+	}
+	if forbidden {
+		return rpcFunction{}, echo.NewHTTPError(
+			http.StatusForbidden, fmt.Sprintf("Permission denied for function %s.%s", schema, name),
+		)
+	}
+	return rpcFunction{}, echo.NewHTTPError(http.StatusBadRequest, mismatch.Error())
+}
+
+// callFunction - calls the function of the request with the role set,
+// writing its rows (or single value) to output
+func (api *API) callFunction(txn txInterface, rpc *grestRPC, scope map[string]interface{}, output encoder) error {
+	params := scope["params"].(map[string]interface{})
+	schema, name, err := rpc.target(params)
+	if err != nil {
+		return err
+	}
+	args, err := rpc.args(scope["body"], params)
+	if err != nil {
+		return err
+	}
+
+	functions, err := loadFunctions(txn, schema, name)
+	if err != nil {
+		log.Println("Failed to load functions", err)
+		return errorMapping(err)
+	}
+	fn, err := pickFunction(functions, schema, name, args)
+	if err != nil {
+		return err
+	}
+
+	sql, queryParams := fn.call(args)
+	log.Println(sql)
+	rows, err := txn.NamedQuery(sql, queryParams)
+	if err != nil {
+		log.Println("Failed to call function", err)
+		return errorMapping(err)
+	}
+	return writeRows(rows, output)
+}
@@ -8,10 +8,11 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 )
 
-func (api *API) addBasicAuth(e *echo.Echo) {
+// addBasicAuth - checks passwords with the check query of the loaded spec
+func (api *API) addBasicAuth(e *echo.Echo, settings *serverSettings) {
 	e.Use(middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
 		rows, err := api.sql.NamedQuery(
-			api.securityQueries["check"],
+			settings.securityQueries["check"],
 			map[string]interface{}{
 				"password": password,
 				"username": username,
@@ -37,19 +38,19 @@ func (api *API) addBasicAuth(e *echo.Echo) {
 	}))
 }
 
-func (api *API) setUser(txn txInterface, username string) error {
-	if _, ok := api.securityQueries["set"]; ok {
+func (settings *serverSettings) setUser(txn txInterface, username string) error {
+	if set, ok := settings.securityQueries["set"]; ok {
 		_, err := txn.NamedExec(
-			fmt.Sprintf(api.securityQueries["set"], username), map[string]interface{}{},
+			fmt.Sprintf(set, username), map[string]interface{}{},
 		)
 		return err
 	}
 	return nil
 }
 
-func (api *API) resetUser(txn txInterface) error {
-	if _, ok := api.securityQueries["reset"]; ok {
-		_, err := txn.NamedExec(api.securityQueries["reset"], map[string]interface{}{})
+func (settings *serverSettings) resetUser(txn txInterface) error {
+	if reset, ok := settings.securityQueries["reset"]; ok {
+		_, err := txn.NamedExec(reset, map[string]interface{}{})
 		return err
 	}
 	return nil
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Options of file backed SQLite databases. WAL lets readers carry on while
+// a write commits, and the busy timeout waits out the other connections'
+// checkpoints instead of failing with "database is locked".
+const sqliteFileOptions = "_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on&_synchronous=NORMAL"
+
+// sqliteFileBackend - a SQLite file read through a pool of connections and
+// written through a single one, as SQLite allows one writer at a time.
+// Write transactions take the lock when they begin (BEGIN IMMEDIATE), so
+// they queue for the writer rather than failing when a read turns into
+// a write.
+type sqliteFileBackend struct {
+	databaseBackend
+	writer *sqlx.DB
+}
+
+// openSqliteFile - opens (creating it if needed) the database at path,
+// like ./grest.db or /var/lib/grest/grest.db
+func openSqliteFile(path string) sqliteFileBackend {
+	dsn := "file:" + strings.NewReplacer("%", "%25", "?", "%3F", "#", "%23").Replace(path) + "?" + sqliteFileOptions
+
+	reader, err := sqlx.Open("sqlite3", dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writer, err := sqlx.Open("sqlite3", dsn+"&_txlock=immediate")
+	if err != nil {
+		log.Fatal(err)
+	}
+	writer.SetMaxOpenConns(1)
+	// Switching to WAL needs to write the file, so fail now when it can't
+	if err := writer.Ping(); err != nil {
+		log.Fatal("Failed to open ", path, ": ", err)
+	}
+	return sqliteFileBackend{databaseBackend{reader}, writer}
+}
+
+func (db sqliteFileBackend) NamedExec(query string, arg interface{}) (sql.Result, error) {
+	return db.writer.NamedExec(query, arg)
+}
+
+func (db sqliteFileBackend) BeginWrite() (txInterface, error) {
+	txn, err := db.writer.Beginx()
+	return txInterface(txBackend{txn}), err
+}
@@ -0,0 +1,515 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// safeSQL - SQL built by the template helpers, so it is quoted already
+type safeSQL string
+
+// Helpers whose output strict templates may print
+var safeFuncs = map[string]bool{
+	"ident": true, "qualified": true, "literal": true, "join": true,
+	"columns": true, "placeholders": true, "oneOf": true,
+	"columnType": true, "columnDefs": true, "assign": true,
+}
+
+// Helper arguments printed as they are, so strict templates must pass them
+// as string constants: the separator of join and the keywords of oneOf
+var constantArgs = map[string]func(position int) bool{
+	"join":  func(position int) bool { return position == 0 },
+	"oneOf": func(position int) bool { return position > 0 },
+}
+
+var paramName = regexp.MustCompile("^[A-Za-z0-9_]+$")
+
+// Prefixes of named params, like rows.0
+var paramPath = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// dialect - quoting rules and column types of a database
+type dialect struct {
+	ident   func(name string) string
+	literal func(value interface{}) string
+	// types maps the allowed column types to native ones
+	types map[string]string
+}
+
+func dialectOf(driverName string) dialect {
+	types, _ := allowedTypes(driverName, supportedTypes())
+	literal := quoteLiteral
+	if driverName == "sqlite3" {
+		literal = quoteSqliteLiteral
+	}
+	return dialect{
+		func(name string) string { return escapeColons(pq.QuoteIdentifier(name)) },
+		func(value interface{}) string { return escapeColons(literal(value)) },
+		types,
+	}
+}
+
+// escapeColons - doubles the colons of quoted SQL. The queries are compiled
+// by sqlx, which reads :word as a named param even between quotes and turns
+// :: back into a single colon.
+func escapeColons(sql string) string {
+	return strings.Replace(sql, ":", "::", -1)
+}
+
+// quoteSqliteLiteral - SQLite literal for a parameter value
+func quoteSqliteLiteral(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if value.(bool) {
+			return "1"
+		}
+		return "0"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(value)
+	case float32, float64:
+		return strconv.FormatFloat(reflect.ValueOf(value).Float(), 'g', -1, 64)
+	case []byte:
+		return "X'" + hex.EncodeToString(value.([]byte)) + "'"
+	case time.Time:
+		return "'" + value.(time.Time).Format(time.RFC3339Nano) + "'"
+	}
+	return "'" + strings.Replace(formatValue(value), "'", "''", -1) + "'"
+}
+
+// names - the keys of an object (or of the first row) or a list of names
+func names(value interface{}) ([]string, error) {
+	switch value.(type) {
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range value.(map[string]interface{}) {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys, nil
+	case []string:
+		return value.([]string), nil
+	case []interface{}:
+		list := value.([]interface{})
+		if len(list) > 0 {
+			if _, ok := list[0].(map[string]interface{}); ok {
+				return names(list[0])
+			}
+		}
+		keys := make([]string, len(list))
+		for i, item := range list {
+			key, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v is not a name", item)
+			}
+			keys[i] = key
+		}
+		return keys, nil
+	}
+	return nil, fmt.Errorf("can't get names from %T", value)
+}
+
+// funcs - template helpers quoting for the dialect
+func (d dialect) funcs() template.FuncMap {
+	ident := func(name interface{}) (safeSQL, error) {
+		switch name.(type) {
+		case safeSQL:
+			return name.(safeSQL), nil
+		case string:
+			if name.(string) != "" {
+				return safeSQL(d.ident(name.(string))), nil
+			}
+		}
+		return "", fmt.Errorf("%v is not an identifier", name)
+	}
+	join := func(sep string, items interface{}) (safeSQL, error) {
+		if sql, ok := items.([]safeSQL); ok {
+			list := make([]string, len(sql))
+			for i, item := range sql {
+				list[i] = string(item)
+			}
+			return safeSQL(strings.Join(list, sep)), nil
+		}
+		list, err := names(items)
+		if err != nil {
+			return "", err
+		}
+		quoted := make([]string, len(list))
+		for i, name := range list {
+			quoted[i] = d.ident(name)
+		}
+		return safeSQL(strings.Join(quoted, sep)), nil
+	}
+
+	// params are the :key (or :prefix.key) named params of an object, or
+	// DEFAULT for the columns a row of an array body leaves out
+	params := func(value interface{}, prefix []string) ([]string, []string, error) {
+		keys, err := names(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, part := range prefix {
+			if !paramPath.MatchString(part) {
+				return nil, nil, fmt.Errorf("%s can't prefix a named parameter", part)
+			}
+		}
+		params := make([]string, len(keys))
+		for i, key := range keys {
+			if !paramName.MatchString(key) {
+				return nil, nil, fmt.Errorf("%s can't be a named parameter", key)
+			}
+			if row, ok := value.(map[string]interface{}); ok {
+				if _, ok := row[key].(defaultValue); ok {
+					params[i] = "DEFAULT"
+					continue
+				}
+			}
+			params[i] = ":" + strings.Join(append(prefix, key), ".")
+		}
+		return keys, params, nil
+	}
+
+	return template.FuncMap{
+		// ident quotes an identifier
+		"ident": ident,
+		// qualified quotes and joins a schema qualified name
+		"qualified": func(parts ...interface{}) (safeSQL, error) {
+			quoted := make([]safeSQL, len(parts))
+			for i, part := range parts {
+				var err error
+				if quoted[i], err = ident(part); err != nil {
+					return "", err
+				}
+			}
+			return join(".", quoted)
+		},
+		// literal quotes a value
+		"literal": func(value interface{}) safeSQL {
+			if sql, ok := value.(safeSQL); ok {
+				return sql
+			}
+			return safeSQL(d.literal(value))
+		},
+		// join quotes names as identifiers and joins them with sep
+		"join": join,
+		// columns lists the quoted keys of an object or of the first row
+		"columns": func(value interface{}) (safeSQL, error) {
+			return join(", ", value)
+		},
+		// placeholders lists :key (or :prefix.key) named params for an object
+		"placeholders": func(value interface{}, prefix ...string) (safeSQL, error) {
+			_, params, err := params(value, prefix)
+			return safeSQL(strings.Join(params, ", ")), err
+		},
+		// assign lists "key" = :key (or :prefix.key) for UPDATE SET
+		"assign": func(value interface{}, prefix ...string) (safeSQL, error) {
+			keys, params, err := params(value, prefix)
+			if err != nil {
+				return "", err
+			}
+			if len(keys) == 0 {
+				return "", fmt.Errorf("nothing to assign")
+			}
+			assignments := make([]string, len(keys))
+			for i, key := range keys {
+				assignments[i] = d.ident(key) + " = " + params[i]
+			}
+			return safeSQL(strings.Join(assignments, ", ")), nil
+		},
+		// oneOf allows a keyword from a fixed list, like a privilege
+		"oneOf": func(value interface{}, allowed ...string) (safeSQL, error) {
+			for _, keyword := range allowed {
+				if strings.EqualFold(fmt.Sprint(value), keyword) {
+					return safeSQL(strings.ToUpper(keyword)), nil
+				}
+			}
+			return "", fmt.Errorf("%v must be one of %s", value, strings.Join(allowed, ", "))
+		},
+		// columnType translates an allowed column type for the dialect
+		"columnType": d.columnType,
+		// columnDefs renders the column definitions of a CREATE TABLE body
+		"columnDefs": d.columnDefs,
+	}
+}
+
+// walkTemplate - visits every node of the template and its partials
+func walkTemplate(t *template.Template, visit func(name string, node parse.Node) error) error {
+	var walk func(name string, node parse.Node) error
+	walk = func(name string, node parse.Node) error {
+		if err := visit(name, node); err != nil {
+			return err
+		}
+		var branch *parse.BranchNode
+		switch node.(type) {
+		case *parse.ListNode:
+			if node.(*parse.ListNode) == nil {
+				return nil
+			}
+			for _, child := range node.(*parse.ListNode).Nodes {
+				if err := walk(name, child); err != nil {
+					return err
+				}
+			}
+		case *parse.IfNode:
+			branch = &node.(*parse.IfNode).BranchNode
+		case *parse.RangeNode:
+			branch = &node.(*parse.RangeNode).BranchNode
+		case *parse.WithNode:
+			branch = &node.(*parse.WithNode).BranchNode
+		}
+		if branch != nil {
+			if err := walk(name, branch.List); err != nil {
+				return err
+			}
+			if branch.ElseList != nil {
+				return walk(name, branch.ElseList)
+			}
+		}
+		return nil
+	}
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree == nil {
+			continue
+		}
+		if err := walk(tmpl.Name(), tmpl.Tree.Root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkStrict - rejects templates printing values without the helpers, or
+// passing the helpers values they print as they are
+func checkStrict(t *template.Template) error {
+	return walkTemplate(t, func(name string, node parse.Node) error {
+		if err := checkConstantArgs(name, nodePipe(node)); err != nil {
+			return err
+		}
+		action, ok := node.(*parse.ActionNode)
+		if !ok {
+			return nil
+		}
+		if len(action.Pipe.Decl) > 0 {
+			// Assignments print nothing
+			return nil
+		}
+		last := action.Pipe.Cmds[len(action.Pipe.Cmds)-1]
+		if ident, ok := last.Args[0].(*parse.IdentifierNode); ok && safeFuncs[ident.Ident] {
+			return nil
+		}
+		return fmt.Errorf(
+			"%s prints %s without quoting it with one of the template helpers",
+			name, node.String(),
+		)
+	})
+}
+
+// checkConstantArgs - rejects pipelines giving constantArgs anything but
+// string constants, including nested pipelines
+func checkConstantArgs(name string, pipe *parse.PipeNode) error {
+	if pipe == nil {
+		return nil
+	}
+	for i, cmd := range pipe.Cmds {
+		var constant func(position int) bool
+		if ident, ok := cmd.Args[0].(*parse.IdentifierNode); ok {
+			constant = constantArgs[ident.Ident]
+		}
+		for position, arg := range cmd.Args[1:] {
+			if nested, ok := arg.(*parse.PipeNode); ok {
+				if err := checkConstantArgs(name, nested); err != nil {
+					return err
+				}
+			}
+			if _, ok := arg.(*parse.StringNode); !ok && constant != nil && constant(position) {
+				return fmt.Errorf("%s passes %s to %s, which prints it unquoted, so it must be a string constant",
+					name, arg.String(), cmd.Args[0].String())
+			}
+		}
+		// The result of the previous command is the last argument
+		if i > 0 && constant != nil && constant(len(cmd.Args)-1) {
+			return fmt.Errorf("%s pipes a value into %s, which prints it unquoted", name, cmd.String())
+		}
+	}
+	return nil
+}
+
+// nodePipe - the pipeline of an action, if, range, with or template node
+func nodePipe(node parse.Node) *parse.PipeNode {
+	switch node.(type) {
+	case *parse.ActionNode:
+		return node.(*parse.ActionNode).Pipe
+	case *parse.IfNode:
+		return node.(*parse.IfNode).Pipe
+	case *parse.RangeNode:
+		return node.(*parse.RangeNode).Pipe
+	case *parse.WithNode:
+		return node.(*parse.WithNode).Pipe
+	case *parse.TemplateNode:
+		return node.(*parse.TemplateNode).Pipe
+	}
+	return nil
+}
+
+// checkBuiltins - rejects templates reading the built-in params like
+// ._now, which only strict templates see as sanitize would refuse them
+func checkBuiltins(t *template.Template) error {
+	var check func(name string, pipe *parse.PipeNode) error
+	check = func(name string, pipe *parse.PipeNode) error {
+		if pipe == nil {
+			return nil
+		}
+		for _, cmd := range pipe.Cmds {
+			for _, arg := range cmd.Args {
+				var fields []string
+				switch arg.(type) {
+				case *parse.PipeNode:
+					if err := check(name, arg.(*parse.PipeNode)); err != nil {
+						return err
+					}
+				case *parse.FieldNode:
+					fields = arg.(*parse.FieldNode).Ident
+				case *parse.VariableNode:
+					// Only $ is the params, other variables are set by the template
+					if ident := arg.(*parse.VariableNode).Ident; ident[0] == "$" {
+						fields = ident[1:]
+					}
+				}
+				if len(fields) > 0 && builtinNames[fields[0]] {
+					return fmt.Errorf(
+						"%s uses %s, which only strict templates may print, bind it as :%s instead",
+						name, fields[0], fields[0],
+					)
+				}
+			}
+		}
+		return nil
+	}
+	return walkTemplate(t, func(name string, node parse.Node) error {
+		return check(name, nodePipe(node))
+	})
+}
+
+// checkPartials - rejects templates invoking undefined partials
+func checkPartials(t *template.Template) error {
+	return walkTemplate(t, func(name string, node parse.Node) error {
+		if partial, ok := node.(*parse.TemplateNode); ok && t.Lookup(partial.Name) == nil {
+			return fmt.Errorf(
+				"%s uses template %s missing from components x-grest-templates",
+				name, partial.Name,
+			)
+		}
+		return nil
+	})
+}
+
+// parsePartial - parses text with access to the partials, which are cloned
+// so that every template may define its own
+func parsePartial(partials *template.Template, name string, text string) (*template.Template, error) {
+	clone, err := partials.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return clone.New(name).Parse(text)
+}
+
+// Prefix of $ref pointing into components x-grest-templates
+const templatesRef = "#/components/x-grest-templates/"
+
+// rawExtension - the JSON of an optional extension
+func rawExtension(value interface{}) json.RawMessage {
+	raw, _ := value.(json.RawMessage)
+	return raw
+}
+
+// parseTemplates - splits components x-grest-templates into the partials,
+// which are strings, and the query lists that x-grest can $ref
+func parseTemplates(raw json.RawMessage, funcs template.FuncMap) (
+	*template.Template, map[string]json.RawMessage, error) {
+
+	partials := template.New("x-grest-templates").Funcs(funcs)
+	refs := map[string]json.RawMessage{}
+	if raw == nil {
+		return partials, refs, nil
+	}
+
+	named := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &named); err != nil {
+		return nil, nil, err
+	}
+	for name, value := range named {
+		var partial string
+		if err := json.Unmarshal(value, &partial); err == nil {
+			if _, err := partials.New(name).Parse(partial); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(string(value)), "[") {
+			// A bare list of queries
+			value = json.RawMessage(`{"queries": ` + string(value) + `}`)
+		}
+		refs[templatesRef+name] = value
+	}
+	return partials, refs, nil
+}
+
+// resolveExtension - parses x-grest, starting from the query list of its
+// $ref if any and splicing in queries given as $ref
+func resolveExtension(raw json.RawMessage, refs map[string]json.RawMessage) (grestExtension, error) {
+	ext := grestExtension{}
+	ref := struct {
+		Ref string `json:"$ref"`
+	}{}
+	if err := json.Unmarshal(raw, &ref); err != nil {
+		return ext, err
+	}
+	if ref.Ref != "" {
+		base, ok := refs[ref.Ref]
+		if !ok {
+			return ext, fmt.Errorf("unknown $ref %s", ref.Ref)
+		}
+		if err := json.Unmarshal(base, &ext); err != nil {
+			return ext, err
+		}
+	}
+	// Fields of the operation override the referenced ones
+	if err := json.Unmarshal(raw, &ext); err != nil {
+		return ext, err
+	}
+
+	queries := []grestQuery{}
+	for _, q := range ext.Queries {
+		if q.Ref == "" {
+			queries = append(queries, q)
+			continue
+		}
+		base, ok := refs[q.Ref]
+		if !ok {
+			return ext, fmt.Errorf("unknown $ref %s", q.Ref)
+		}
+		spliced := grestExtension{}
+		if err := json.Unmarshal(base, &spliced); err != nil {
+			return ext, err
+		}
+		for _, nested := range spliced.Queries {
+			if nested.Ref != "" {
+				return ext, fmt.Errorf("%s can't $ref %s, query lists don't nest", q.Ref, nested.Ref)
+			}
+		}
+		queries = append(queries, spliced.Queries...)
+	}
+	ext.Queries = queries
+	return ext, nil
+}
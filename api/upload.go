@@ -0,0 +1,378 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Largest file (or form field) accepted unless x-grest upload sets maxSize
+const defaultUploadSize = 32 << 20
+
+// Most parts of a multipart body unless x-grest upload sets maxParts
+const defaultUploadParts = 64
+
+// Room for multipart headers and form fields in the default maxBodySize
+const uploadOverhead = 1 << 20
+
+// Chunks written by lo_put, and read by lo_get, when the driver has no
+// large object protocol
+const largeObjectChunk = 1 << 20
+
+var errLargeObject = errors.New("large objects are only supported by Postgres")
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// grestUpload - x-grest upload settings for multipart/form-data and
+// application/octet-stream bodies
+type grestUpload struct {
+	// MaxSize is the largest file in bytes
+	MaxSize int64 `json:"maxSize"`
+	// MaxBodySize is the largest request body in bytes, defaults to four
+	// times maxSize (plus a MiB for headers and fields)
+	MaxBodySize int64 `json:"maxBodySize"`
+	// MaxParts is the most files and fields of a multipart body
+	MaxParts int `json:"maxParts"`
+	// LargeObject streams files into Postgres large objects, bound as
+	// :file.oid instead of :file.content
+	LargeObject bool `json:"largeObject"`
+}
+
+func (u *grestUpload) compile(name string) (grestUpload, error) {
+	upload := grestUpload{}
+	if u != nil {
+		upload = *u
+	}
+	if upload.MaxSize < 0 || upload.MaxBodySize < 0 || upload.MaxParts < 0 {
+		return grestUpload{}, fmt.Errorf("Extension x-grest upload sizes must be positive at %s", name)
+	}
+	if upload.MaxSize == 0 {
+		upload.MaxSize = defaultUploadSize
+	}
+	if upload.MaxBodySize == 0 {
+		upload.MaxBodySize = 4*upload.MaxSize + uploadOverhead
+	}
+	if upload.MaxParts == 0 {
+		upload.MaxParts = defaultUploadParts
+	}
+	return upload, nil
+}
+
+// isUpload - whether the request body is a file upload
+func isUpload(c echo.Context) bool {
+	contentType := c.Request().Header.Get(echo.HeaderContentType)
+	return strings.HasPrefix(contentType, echo.MIMEMultipartForm) ||
+		strings.HasPrefix(contentType, echo.MIMEOctetStream)
+}
+
+// uploadBody - an upload read in the transaction, so files can be streamed
+// into large objects
+type uploadBody struct {
+	settings grestUpload
+	request  *http.Request
+}
+
+// bind - reads the files into :name.content (or :name.oid), :name.name,
+// :name.size, :name.sha256 and :name.content_type and other form fields
+// into :name
+func (u uploadBody) bind(txn txInterface, params map[string]interface{}) error {
+	u.request.Body = &bodyLimit{r: u.request.Body, left: u.settings.MaxBodySize, closer: u.request.Body}
+	contentType := u.request.Header.Get(echo.HeaderContentType)
+	if strings.HasPrefix(contentType, echo.MIMEOctetStream) {
+		name := ""
+		if _, disposition, err := mime.ParseMediaType(
+			u.request.Header.Get(echo.HeaderContentDisposition),
+		); err == nil {
+			name = disposition["filename"]
+		}
+		return u.bindFile(txn, "file", name, contentType, u.request.Body, params)
+	}
+
+	reader, err := u.request.MultipartReader()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	for parts := 0; ; parts++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return u.readError(err)
+		}
+		if parts == u.settings.MaxParts {
+			return echo.NewHTTPError(
+				http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Uploads have at most %d parts", u.settings.MaxParts),
+			)
+		}
+		if err := u.bindPart(txn, part, params); err != nil {
+			return err
+		}
+	}
+}
+
+func (u uploadBody) bindPart(txn txInterface, part *multipart.Part, params map[string]interface{}) error {
+	defer part.Close()
+	name := paramKey(part.FormName())
+	if part.FileName() == "" {
+		value, err := u.readAll(name, part)
+		if err != nil {
+			return err
+		}
+		params[name] = string(value)
+		return nil
+	}
+	contentType := part.Header.Get(echo.HeaderContentType)
+	if contentType == "" {
+		contentType = echo.MIMEOctetStream
+	}
+	return u.bindFile(txn, name, part.FileName(), contentType, part, params)
+}
+
+func (u uploadBody) bindFile(
+	txn txInterface, name string, filename string, contentType string,
+	r io.Reader, params map[string]interface{}) error {
+
+	params[name+".name"] = filename
+	params[name+".content_type"] = contentType
+
+	if !u.settings.LargeObject {
+		content, err := u.readAll(name, r)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		params[name+".content"] = content
+		params[name+".size"] = int64(len(content))
+		params[name+".sha256"] = hex.EncodeToString(sum[:])
+		return nil
+	}
+
+	limited := &countingReader{r: io.LimitReader(r, u.settings.MaxSize+1), hash: sha256.New()}
+	oid, err := txn.LargeObject(limited)
+	if err == errLargeObject {
+		return echo.NewHTTPError(http.StatusNotImplemented, err.Error())
+	} else if errors.Is(err, errBodyTooLarge) {
+		return u.readError(err)
+	} else if err != nil {
+		log.Println("Failed to write large object", err)
+		return errorMapping(err)
+	}
+	if limited.count > u.settings.MaxSize {
+		return u.tooLarge(name)
+	}
+	params[name+".oid"] = int64(oid)
+	params[name+".size"] = limited.count
+	params[name+".sha256"] = hex.EncodeToString(limited.hash.Sum(nil))
+	return nil
+}
+
+func (u uploadBody) readAll(name string, r io.Reader) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r, u.settings.MaxSize+1))
+	if err != nil {
+		return nil, u.readError(err)
+	}
+	if int64(len(content)) > u.settings.MaxSize {
+		return nil, u.tooLarge(name)
+	}
+	return content, nil
+}
+
+func (u uploadBody) tooLarge(name string) error {
+	return echo.NewHTTPError(
+		http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("%s is larger than %d bytes", name, u.settings.MaxSize),
+	)
+}
+
+// readError - 413 once the body is over maxBodySize, otherwise 400
+func (u uploadBody) readError(err error) error {
+	if errors.Is(err, errBodyTooLarge) {
+		return echo.NewHTTPError(
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Request body is larger than %d bytes", u.settings.MaxBodySize),
+		)
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
+
+// bodyLimit - fails reads past the limit, rather than ending the body early
+// like io.LimitReader
+type bodyLimit struct {
+	r      io.Reader
+	left   int64
+	closer io.Closer
+}
+
+func (l *bodyLimit) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// One more byte tells a body of exactly the limit from a larger one
+		if n, _ := l.r.Read(make([]byte, 1)); n > 0 {
+			return 0, errBodyTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+func (l *bodyLimit) Close() error {
+	return l.closer.Close()
+}
+
+// countingReader - counts and hashes what is read, so a large object has
+// its size and hash without reading it again
+type countingReader struct {
+	r     io.Reader
+	count int64
+	hash  hash.Hash
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.count += int64(n)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+// largeObjectFromBytes - large objects through SQL for drivers without the
+// large object protocol, written in chunks so the file is never held whole
+func largeObjectFromBytes(txn txInterface, r io.Reader) (uint32, error) {
+	created, err := queryInt(txn, "SELECT lo_create(0) AS oid", map[string]interface{}{})
+	if err != nil {
+		return 0, err
+	}
+	oid := uint32(created)
+
+	chunk := make([]byte, largeObjectChunk)
+	for offset := int64(0); ; {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if _, err := txn.NamedExec("SELECT lo_put(:oid, :offset, :chunk)", map[string]interface{}{
+				"oid": int64(oid), "offset": offset, "chunk": chunk[:n],
+			}); err != nil {
+				return 0, err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return oid, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// sqlLargeObject - reads a large object through SQL for drivers without
+// the large object protocol, a chunk at a time
+type sqlLargeObject struct {
+	txn    txInterface
+	oid    int64
+	size   int64
+	offset int64
+	// chunk holds the bytes at chunkOffset
+	chunk       []byte
+	chunkOffset int64
+}
+
+// openSQLLargeObject - opens a large object for sqlLargeObject, finding
+// its size with a descriptor that is closed again
+func openSQLLargeObject(txn txInterface, oid uint32) (*sqlLargeObject, error) {
+	object := &sqlLargeObject{txn: txn, oid: int64(oid)}
+	// INV_READ
+	fd, err := queryInt(txn, "SELECT lo_open(:oid, 262144) AS fd", map[string]interface{}{"oid": object.oid})
+	if err != nil {
+		return nil, err
+	}
+	if object.size, err = queryInt(
+		txn, "SELECT lo_lseek64(:fd, 0, 2) AS size", map[string]interface{}{"fd": fd},
+	); err != nil {
+		return nil, err
+	}
+	if _, err := txn.NamedExec("SELECT lo_close(:fd)", map[string]interface{}{"fd": fd}); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+func (o *sqlLargeObject) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.offset < o.chunkOffset || o.offset >= o.chunkOffset+int64(len(o.chunk)) {
+		rows, err := o.txn.NamedQuery(
+			"SELECT lo_get(:oid, :offset, :length) AS content",
+			map[string]interface{}{"oid": o.oid, "offset": o.offset, "length": largeObjectChunk},
+		)
+		if err != nil {
+			return 0, err
+		}
+		var chunk []byte
+		if rows.Next() {
+			err = rows.Scan(&chunk)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			return 0, err
+		}
+		if len(chunk) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		o.chunk, o.chunkOffset = chunk, o.offset
+	}
+	n := copy(p, o.chunk[o.offset-o.chunkOffset:])
+	o.offset += int64(n)
+	return n, nil
+}
+
+func (o *sqlLargeObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the large object")
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+// queryInt - runs a query returning a single integer
+func queryInt(txn txInterface, query string, arg interface{}) (int64, error) {
+	rows, err := txn.NamedQuery(query, arg)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var value int64
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%s returned no rows", query)
+	}
+	if err := rows.Scan(&value); err != nil {
+		return 0, err
+	}
+	return value, rows.Err()
+}
@@ -1,10 +1,12 @@
 module github.com/aidan-plenert-macdonald/grest
 
-go 1.15
+go 1.16
 
 require (
+	github.com/apache/arrow/go/arrow v0.0.0-20210105145422-88aaea5262db
 	github.com/cockroachdb/cockroach-go/v2 v2.1.0
 	github.com/getkin/kin-openapi v0.32.0
+	github.com/ghodss/yaml v1.0.0
 	github.com/gofrs/uuid v3.3.0+incompatible // indirect
 	github.com/jackc/fake v0.0.0-20150926172116-812a484cc733 // indirect
 	github.com/jackc/pgerrcode v0.0.0-20201024163028-a0d42d470451
@@ -1,15 +1,196 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/aidan-plenert-macdonald/grest/api"
+	"github.com/ghodss/yaml"
 )
 
 func main() {
-	e := api.NewApi(
-		"jdbc:postgres://localhost:5432/postgres",
-	).GetServer(
-		"./openapi.yml",
-	)
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		generate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		client(os.Args[2:])
+		return
+	}
+
+	serve(os.Args[1:])
+}
+
+// specList - the repeated --spec flag
+type specList []string
+
+func (s *specList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *specList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// serve - serves the specs, reloading them when the files change, on SIGHUP or
+// on POST to the admin path
+func serve(args []string) {
+	flags := flag.NewFlagSet("grest", flag.ExitOnError)
+	db := flags.String("db", "jdbc:postgres://localhost:5432/postgres", "database to serve")
+	specs := specList{}
+	flags.Var(&specs, "spec", "spec file or directory of the API, repeated to merge several (default ./openapi.yml)")
+	addr := flags.String("addr", ":8080", "address to listen on")
+	watch := flags.Duration("watch", time.Second, "how often to check the spec for changes, 0 to never")
+	adminPath := flags.String("reload-path", "", "path of a POST endpoint reloading the spec, none if empty")
+	admins := flags.String("reload-users", "", "comma separated users allowed to POST to reload-path")
+	flags.Parse(args)
+	if len(specs) == 0 {
+		specs = specList{"./openapi.yml"}
+	}
+
+	allowed := []string{}
+	if *admins != "" {
+		allowed = strings.Split(*admins, ",")
+	}
+	reloader, err := api.NewApi(*db).NewReloader(*adminPath, allowed, specs...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := reloader.Reload(); err != nil {
+				log.Println("Failed to reload", specs, err)
+			} else {
+				log.Println("Reloaded", specs)
+			}
+		}
+	}()
+	if *watch > 0 {
+		go reloader.Watch(*watch, nil)
+	}
+
+	log.Fatal(http.ListenAndServe(*addr, reloader))
+}
+
+// generate - writes a spec with CRUD operations for the tables of a schema
+func generate(args []string) {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	db := flags.String("db", "jdbc:postgres://localhost:5432/postgres", "database to introspect")
+	schema := flags.String("schema", "public", "schema of the tables")
+	out := flags.String("out", "", "file to write the spec to, stdout if empty")
+	maxLimit := flags.Int("max-limit", 1000, "most rows a list operation returns")
+	flags.Parse(args)
+	if *maxLimit <= 0 {
+		log.Fatal("--max-limit must be positive")
+	}
+
+	swagger, err := api.NewApi(*db).GenerateSpec(*schema, *maxLimit)
+	if err != nil {
+		log.Fatal("Failed to introspect ", *schema, " : ", err)
+	}
+	spec, err := yaml.Marshal(swagger)
+	if err != nil {
+		log.Fatal("Failed to write spec : ", err)
+	}
+	if *out == "" {
+		os.Stdout.Write(spec)
+	} else if err := ioutil.WriteFile(*out, spec, 0644); err != nil {
+		log.Fatal("Failed to write spec : ", err)
+	}
+}
+
+// client - writes a typed Go client of the specs
+func client(args []string) {
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	specs := specList{}
+	flags.Var(&specs, "spec", "spec file or directory, repeated to merge several (default ./openapi.yml)")
+	pkg := flags.String("package", "client", "package of the generated client")
+	out := flags.String("out", "", "file to write the client to, stdout if empty")
+	flags.Parse(args)
+	if len(specs) == 0 {
+		specs = specList{"./openapi.yml"}
+	}
+
+	swagger, err := api.LoadSpec(specs...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	source, err := api.GenerateClient(swagger, *pkg)
+	if err != nil {
+		log.Fatal("Failed to generate client : ", err)
+	}
+	if *out == "" {
+		os.Stdout.Write(source)
+	} else if err := ioutil.WriteFile(*out, source, 0644); err != nil {
+		log.Fatal("Failed to write client : ", err)
+	}
+}
+
+// migrate - applies, reverts, lists or creates the migrations of a directory
+func migrate(args []string) {
+	usage := "Usage: grest migrate up|down|status|create [flags]"
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	db := flags.String("db", "jdbc:postgres://localhost:5432/postgres", "database to migrate")
+	dir := flags.String("dir", "./migrations", "directory of the migration files")
+	steps := flags.Int("steps", 1, "migrations reverted by down")
+	flags.Parse(args[1:])
 
-	e.Logger.Fatal(e.Start(":8080"))
+	switch args[0] {
+	case "up":
+		applied, err := api.NewApi(*db).Migrate(*dir)
+		for _, m := range applied {
+			fmt.Printf("Applied %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal("Failed to migrate : ", err)
+		}
+	case "down":
+		reverted, err := api.NewApi(*db).MigrateDown(*dir, *steps)
+		for _, m := range reverted {
+			fmt.Printf("Reverted %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal("Failed to migrate : ", err)
+		}
+	case "status":
+		status, err := api.NewApi(*db).MigrationStatus(*dir)
+		if err != nil {
+			log.Fatal("Failed to read migrations : ", err)
+		}
+		for _, s := range status {
+			fmt.Printf("%d\t%s\t%s\t%s\n", s.Version, s.Name, s.State, s.AppliedAt)
+		}
+	case "create":
+		if flags.NArg() != 1 {
+			log.Fatal("Usage: grest migrate create [flags] name")
+		}
+		paths, err := api.CreateMigration(*dir, flags.Arg(0))
+		if err != nil {
+			log.Fatal("Failed to create migration : ", err)
+		}
+		for _, path := range paths {
+			fmt.Println(path)
+		}
+	default:
+		log.Fatal(usage)
+	}
 }
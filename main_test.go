@@ -1,10 +1,13 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -54,12 +57,12 @@ func TestGets(t *testing.T) {
 			http.StatusUnauthorized, "nonexistant", "test", NoTest,
 		},
 		{
-			httptest.NewRequest(http.MethodDelete, "/_data/postgres/public/testtable", nil),
+			httptest.NewRequest(http.MethodDelete, "/_ddl/postgres/public/testtable", nil),
 			http.StatusOK, "test", "test", NoTest,
 		},
 		{
 			httptest.NewRequest(
-				http.MethodPut, "/_data/postgres/public/testtable",
+				http.MethodPut, "/_ddl/postgres/public/testtable",
 				strings.NewReader(
 					`{"col": "real"}`,
 				),
@@ -80,7 +83,7 @@ func TestGets(t *testing.T) {
 			http.StatusOK, "test", "test", NoTest,
 		},
 		{
-			httptest.NewRequest(http.MethodDelete, "/_data/postgres/public/testtable", nil),
+			httptest.NewRequest(http.MethodDelete, "/_ddl/postgres/public/testtable", nil),
 			http.StatusOK, "test", "test", NoTest,
 		},
 		{
@@ -109,7 +112,7 @@ func TestGets(t *testing.T) {
 		// Create table as newuser
 		{
 			httptest.NewRequest(
-				http.MethodPut, "/_data/postgres/public/testtable",
+				http.MethodPut, "/_ddl/postgres/public/testtable",
 				strings.NewReader(
 					`{"col": "real"}`,
 				),
@@ -231,3 +234,54 @@ func TestGets(t *testing.T) {
 		)
 	}
 }
+
+// Exports run through pgx's COPY TO STDOUT, with the params inlined
+func TestExport(t *testing.T) {
+	spec := `{
+		"openapi": "3.0.2",
+		"info": {"title": "export", "version": "1.0"},
+		"paths": {
+			"/export": {
+				"get": {
+					"responses": {"200": {"description": "OK", "content": {"text/csv": {"schema": {"type": "string"}}}}},
+					"parameters": [{"in": "query", "name": "note", "schema": {"type": "string"}}],
+					"x-grest": {
+						"copyTo": {"format": "csv"},
+						"queries": [{"sql": "SELECT '$1' AS dollar, CAST(:note AS text) AS note, 1 AS one"}]
+					}
+				}
+			}
+		}
+	}`
+	path := filepath.Join(t.TempDir(), "export.json")
+	if err := ioutil.WriteFile(path, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := api.NewApi("jdbc:postgres://localhost:5432/postgres").GetServer(path)
+	want := "dollar,note,one\n$1,12:30,1\n"
+
+	for encoding, gzipped := range map[string]bool{"": false, "gzip;q=0": false, "deflate, gzip": true} {
+		t.Run(encoding, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/export?note=12:30", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK || (rec.Header().Get("Content-Encoding") == "gzip") != gzipped {
+				t.Fatal("Unexpected response", rec.Code, rec.Header(), rec.Body.String())
+			}
+			body := rec.Body.Bytes()
+			if gzipped {
+				reader, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = ioutil.ReadAll(reader); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != want {
+				t.Errorf("Export = %q want %q", body, want)
+			}
+		})
+	}
+}